@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type affiliationOutput struct {
+	Profile    *string                `yaml:"profile,omitempty"`
+	Date       string                 `yaml:"date"`
+	Project    string                 `yaml:"project,omitempty"`
+	Source     string                 `yaml:"source"`
+	Enrollment *enrollmentShortOutput `yaml:"enrollment,omitempty"`
+}
+
+func (e *enrollmentShortOutput) active(dt string) bool {
+	return e.Start <= dt && dt < e.End
+}
+
+// pickEnrollment returns enrollment active at a given date for the first matching project in chain,
+// if none matches - global enrollment active at a given date is returned
+func pickEnrollment(rols []*enrollmentShortOutput, dt string, chain []string) *enrollmentShortOutput {
+	var global *enrollmentShortOutput
+	bySlug := make(map[string]*enrollmentShortOutput)
+	for _, rol := range rols {
+		if !rol.active(dt) {
+			continue
+		}
+		if rol.ProjectSlug == nil {
+			if global == nil {
+				global = rol
+			}
+			continue
+		}
+		if _, ok := bySlug[*rol.ProjectSlug]; !ok {
+			bySlug[*rol.ProjectSlug] = rol
+		}
+	}
+	for _, slug := range chain {
+		rol, ok := bySlug[slug]
+		if ok {
+			return rol
+		}
+	}
+	return global
+}
+
+// findEnrollment returns enrollment valid for a given profile at a given date (YYYY-MM-DD) and project,
+// project specific enrollments win over global ones, enrollments for parent projects are inherited by child projects,
+// when no explicit enrollment matches - domain rules for profile's emails are used as a fallback
+func findEnrollment(prof *allOutput, emails []string, dt, project string, rules *domainRules, projs *projects) (*enrollmentShortOutput, string) {
+	chain := projs.ancestors(project)
+	if prof != nil {
+		rol := pickEnrollment(prof.Enrollments, dt, chain)
+		if rol != nil {
+			return rol, "enrollment"
+		}
+		emails = append(profileEmails(prof), emails...)
+	}
+	var rols []*enrollmentShortOutput
+	for _, email := range emails {
+		for _, rule := range rules.match(email) {
+			rols = append(rols, rule.enrollment())
+		}
+	}
+	rol := pickEnrollment(rols, dt, chain)
+	if rol != nil {
+		return rol, "domain"
+	}
+	return nil, "none"
+}
+
+// findProfiles returns profiles having identity matching query: email, username or name,
+// names are compared in normalized form, so "lukasz gryglicki" finds "Łukasz Gryglicki"
+func findProfiles(profs []*allOutput, query string) (found []*allOutput) {
+	isEmail := strings.ContainsAny(query, "!@")
+	q := strings.ToLower(strings.TrimSpace(query))
+	if isEmail {
+		q = normalizeEmail(query)
+	}
+	name := normalizeName(query, gCfg.Transliterate)
+	for _, prof := range profs {
+		match := false
+		if isEmail {
+			for _, email := range profileEmails(prof) {
+				if email == q {
+					match = true
+					break
+				}
+			}
+		} else {
+			if prof.Name != nil && normalizeName(*prof.Name, gCfg.Transliterate) == name {
+				match = true
+			}
+			for _, identity := range prof.Identities {
+				if match {
+					break
+				}
+				if identity.Username != nil && strings.ToLower(*identity.Username) == q {
+					match = true
+				}
+				if identity.Name != nil && normalizeName(*identity.Name, gCfg.Transliterate) == name {
+					match = true
+				}
+			}
+		}
+		if match {
+			found = append(found, prof)
+		}
+	}
+	return
+}
+
+// affiliationCommand: gitdm-sync affiliation email|username|name YYYY-MM-DD [project_slug]
+func affiliationCommand(ctx context.Context, args []string) bool {
+	if len(args) < 2 {
+		fatalf(ctx, false, "usage: affiliation email|username|name YYYY-MM-DD [project_slug]")
+		return false
+	}
+	query, dt, project := args[0], args[1], ""
+	if len(args) > 2 {
+		project = args[2]
+	}
+	if !validDate(dt) {
+		fatalf(ctx, false, "invalid date '%s', expected YYYY-MM-DD", dt)
+		return false
+	}
+	profs, ok := getProfilesFromYAMLs(ctx)
+	if !ok {
+		return false
+	}
+	rules, ok := getDomainRules(ctx)
+	if !ok {
+		return false
+	}
+	projs, ok := getProjects(ctx)
+	if !ok {
+		return false
+	}
+	found := findProfiles(profs, query)
+	var emails []string
+	if strings.ContainsAny(query, "!@") {
+		emails = append(emails, normalizeEmail(query))
+	}
+	if len(found) == 0 {
+		found = []*allOutput{nil}
+	}
+	var out []*affiliationOutput
+	for _, prof := range found {
+		rol, source := findEnrollment(prof, emails, dt, project, rules, projs)
+		res := &affiliationOutput{Date: dt, Project: project, Source: source, Enrollment: rol}
+		if prof != nil {
+			res.Profile = prof.Name
+		}
+		out = append(out, res)
+	}
+	data, err := yaml.Marshal(out)
+	if fatalOnError(ctx, err, false) {
+		return false
+	}
+	fmt.Printf("%s", data)
+	return true
+}
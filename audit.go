@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const auditDir = "audit"
+
+// auditRecord is a single DB update, records are appended to data_dir/audit/YYYY-MM.jsonl files and never modified
+type auditRecord struct {
+	ID       string       `json:"id,omitempty"`
+	Time     string       `json:"time"`
+	Trigger  string       `json:"trigger"`
+	Caller   string       `json:"caller,omitempty"`
+	PR       int64        `json:"pr,omitempty"`
+	SHA      string       `json:"sha"`
+	Response string       `json:"response"`
+	Add      []*allOutput `json:"add,omitempty"`
+	Del      []*allOutput `json:"del,omitempty"`
+}
+
+// auditEntryOutput is audit record as returned by queries, changes are computed between deleted and added profiles
+type auditEntryOutput struct {
+	ID       string              `yaml:"id,omitempty"`
+	Time     string              `yaml:"time"`
+	Trigger  string              `yaml:"trigger"`
+	Caller   string              `yaml:"caller,omitempty"`
+	PR       int64               `yaml:"pr,omitempty"`
+	SHA      string              `yaml:"sha"`
+	Response string              `yaml:"response"`
+	Added    int                 `yaml:"added"`
+	Deleted  int                 `yaml:"deleted"`
+	Changes  *profilesDiffOutput `yaml:"changes,omitempty"`
+	Add      []*allOutput        `yaml:"add,omitempty"`
+	Del      []*allOutput        `yaml:"del,omitempty"`
+}
+
+// auditQuery selects audit records: profile is email, username or name (as in affiliation command),
+// since and until are YYYY-MM-DD dates (inclusive), sha is a commit SHA prefix, full includes complete add/del sets
+type auditQuery struct {
+	Profile string
+	Since   string
+	Until   string
+	SHA     string
+	Full    bool
+}
+
+func auditPath(tm time.Time) string {
+	return filepath.Join(gCfg.DataDir, auditDir, tm.Format("2006-01")+".jsonl")
+}
+
+// appendAudit appends record as a single line and syncs it to disk
+func appendAudit(rec *auditRecord) error {
+	tm, err := time.Parse(dateTimeFormat, rec.Time)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	fn := auditPath(tm)
+	err = os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return errors.Wrap(err, fn)
+}
+
+// recordAudit records DB update with a given sync ID done by a given commit info
+func recordAudit(ctx context.Context, id string, info *commitInfo, sha, response string, addDB, delDB []*allOutput) bool {
+	rec := &auditRecord{
+		ID:       id,
+		Time:     time.Now().Format(dateTimeFormat),
+		Trigger:  info.Trigger,
+		Caller:   info.Caller,
+		PR:       info.PR,
+		SHA:      sha,
+		Response: response,
+		Add:      addDB,
+		Del:      delDB,
+	}
+	mPrintf(ctx, "recording audit: %d added, %d deleted\n", len(addDB), len(delDB))
+	return !fatalOnError(ctx, appendAudit(rec), false)
+}
+
+func (q *auditQuery) validate() error {
+	for _, dt := range []string{q.Since, q.Until} {
+		if dt != "" && !validDate(dt) {
+			return fmt.Errorf("invalid date '%s', expected YYYY-MM-DD", dt)
+		}
+	}
+	return nil
+}
+
+// match returns query result for a given record, nil when record doesn't match
+func (q *auditQuery) match(rec *auditRecord) *auditEntryOutput {
+	day := rec.Time
+	if len(day) > len(dateFormat) {
+		day = day[:len(dateFormat)]
+	}
+	if (q.Since != "" && day < q.Since) || (q.Until != "" && day > q.Until) || !strings.HasPrefix(rec.SHA, q.SHA) {
+		return nil
+	}
+	add, del := rec.Add, rec.Del
+	if q.Profile != "" {
+		add, del = findProfiles(add, q.Profile), findProfiles(del, q.Profile)
+		if len(add) == 0 && len(del) == 0 {
+			return nil
+		}
+	}
+	entry := &auditEntryOutput{
+		ID:       rec.ID,
+		Time:     rec.Time,
+		Trigger:  rec.Trigger,
+		Caller:   rec.Caller,
+		PR:       rec.PR,
+		SHA:      rec.SHA,
+		Response: rec.Response,
+		Added:    len(add),
+		Deleted:  len(del),
+		// DB update replaces changed profile: old version is deleted and the new one is added
+		Changes: diffProfiles(del, add),
+	}
+	if q.Full {
+		entry.Add, entry.Del = add, del
+	}
+	return entry
+}
+
+// findAudit returns audit record with a given sync ID
+func findAudit(id string) (*auditRecord, error) {
+	files, err := filepath.Glob(filepath.Join(gCfg.DataDir, auditDir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var found *auditRecord
+	for _, fn := range files {
+		err = readAuditFile(fn, func(rec *auditRecord) {
+			if rec.ID == id {
+				found = rec
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("sync '%s' not found in audit log", id)
+	}
+	return found, nil
+}
+
+// queryAudit returns matching audit records, oldest first
+func queryAudit(q *auditQuery) ([]*auditEntryOutput, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(gCfg.DataDir, auditDir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	entries := []*auditEntryOutput{}
+	for _, fn := range files {
+		month := strings.TrimSuffix(filepath.Base(fn), ".jsonl")
+		if (q.Since != "" && month < q.Since[:7]) || (q.Until != "" && month > q.Until[:7]) {
+			continue
+		}
+		err = readAuditFile(fn, func(rec *auditRecord) {
+			if entry := q.match(rec); entry != nil {
+				entries = append(entries, entry)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// readAuditFile calls process for each record, records can be large (first sync adds all profiles), so lines are not limited
+func readAuditFile(fn string, process func(*auditRecord)) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	rd := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			// the last line without new line is still being written
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+		rec := &auditRecord{}
+		if err = json.Unmarshal(data, rec); err != nil {
+			return fmt.Errorf("%s:%d: %v", fn, line, err)
+		}
+		process(rec)
+	}
+}
+
+// handleAudit: GET /audit?profile=...&since=YYYY-MM-DD&until=YYYY-MM-DD&sha=...&full=1
+func handleAudit(w http.ResponseWriter, req *http.Request) {
+	v := req.URL.Query()
+	q := &auditQuery{Profile: v.Get("profile"), Since: v.Get("since"), Until: v.Get("until"), SHA: v.Get("sha"), Full: v.Get("full") == "1"}
+	entries, err := queryAudit(q)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, timeStampStr()+redact(err.Error())+"\n")
+		return
+	}
+	data, err := yaml.Marshal(entries)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, timeStampStr()+err.Error()+"\n")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// auditCommand: gitdm-sync audit email|username|name|- [since YYYY-MM-DD] [until YYYY-MM-DD] [sha SHA] [full]
+// - shows DB updates recorded by the service in data_dir ("-" matches all profiles)
+func auditCommand(ctx context.Context, args []string) bool {
+	usage := "usage: audit email|username|name|- [since YYYY-MM-DD] [until YYYY-MM-DD] [sha SHA] [full]"
+	if len(args) < 1 {
+		fatalf(ctx, false, "%s", usage)
+		return false
+	}
+	q := &auditQuery{}
+	if args[0] != "-" {
+		q.Profile = args[0]
+	}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "full" {
+			q.Full = true
+			continue
+		}
+		if i+1 >= len(args) {
+			fatalf(ctx, false, "%s", usage)
+			return false
+		}
+		i++
+		switch arg {
+		case "since":
+			q.Since = args[i]
+		case "until":
+			q.Until = args[i]
+		case "sha":
+			q.SHA = args[i]
+		default:
+			fatalf(ctx, false, "%s", usage)
+			return false
+		}
+	}
+	entries, err := queryAudit(q)
+	if fatalOnError(ctx, err, false) {
+		return false
+	}
+	mPrintf(ctx, "found %d audit records\n", len(entries))
+	data, err := yaml.Marshal(entries)
+	if fatalOnError(ctx, err, false) {
+		return false
+	}
+	fmt.Printf("%s", data)
+	return true
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// testAuditLog points data_dir to a temporary directory and appends records of three DB updates in two months
+func testAuditLog(t *testing.T) {
+	saved := gCfg
+	t.Cleanup(func() { gCfg = saved })
+	cfg := *saved
+	cfg.DataDir, cfg.LogLevel = t.TempDir(), levelWarn
+	gCfg = &cfg
+	acme, other := testEnrollment("Acme", "1900-01-01", "2100-01-01", nil), testEnrollment("Other", "1900-01-01", "2100-01-01", nil)
+	recs := []*auditRecord{
+		{
+			ID: "s1", Time: "2024-01-15 10:00:00", Trigger: "push", Caller: "github:jdoe", SHA: "aaa111", Response: "updated",
+			Add: []*allOutput{testProfile("John Doe", "john@example.com", "jdoe", acme)},
+		},
+		{
+			ID: "s2", Time: "2024-02-03 11:00:00", Trigger: "push", PR: 12, SHA: "bbb222", Response: "updated",
+			Add: []*allOutput{testProfile("John Doe", "john@example.com", "jdoe", other)},
+			Del: []*allOutput{testProfile("John Doe", "john@example.com", "jdoe", acme)},
+		},
+		{
+			ID: "s3", Time: "2024-02-20 12:00:00", Trigger: "sync repo", Caller: "ssaw", SHA: "ccc333", Response: "updated",
+			Add: []*allOutput{testProfile("Jane Roe", "jane@example.com", "", acme)},
+		},
+	}
+	for _, rec := range recs {
+		if err := appendAudit(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppendAudit(t *testing.T) {
+	testAuditLog(t)
+	var cases = []struct {
+		month string
+		ids   []string
+	}{
+		{month: "2024-01", ids: []string{"s1"}},
+		{month: "2024-02", ids: []string{"s2", "s3"}},
+	}
+	for _, c := range cases {
+		fn := filepath.Join(gCfg.DataDir, auditDir, c.month+".jsonl")
+		var ids []string
+		if err := readAuditFile(fn, func(rec *auditRecord) { ids = append(ids, rec.ID) }); err != nil {
+			t.Errorf("%s: %v", c.month, err)
+		}
+		if strings.Join(ids, ",") != strings.Join(c.ids, ",") {
+			t.Errorf("%s: got records %v, want %v", c.month, ids, c.ids)
+		}
+	}
+	info := newCommitInfo("push", "github:jdoe")
+	info.PR = 13
+	if !recordAudit(context.Background(), "s4", info, "ddd444", "updated", []*allOutput{testProfile("New", "new@example.com", "")}, nil) {
+		t.Fatal("recording audit failed")
+	}
+	rec, err := findAudit("s4")
+	if err != nil || rec.Trigger != "push" || rec.Caller != "github:jdoe" || rec.PR != 13 || rec.SHA != "ddd444" || len(rec.Add) != 1 {
+		t.Fatalf("got %+v, error %v", rec, err)
+	}
+	if _, err := os.Stat(auditPath(time.Now())); err != nil {
+		t.Errorf("current month file: %v", err)
+	}
+	if err := appendAudit(&auditRecord{ID: "bad", Time: "yesterday"}); err == nil {
+		t.Errorf("record with invalid time appended")
+	}
+}
+
+func TestQueryAudit(t *testing.T) {
+	testAuditLog(t)
+	var cases = []struct {
+		name string
+		q    auditQuery
+		ids  []string
+		err  string
+	}{
+		{name: "all", ids: []string{"s1", "s2", "s3"}},
+		{name: "email", q: auditQuery{Profile: "john!example.com"}, ids: []string{"s1", "s2"}},
+		{name: "username", q: auditQuery{Profile: "JDoe"}, ids: []string{"s1", "s2"}},
+		{name: "name", q: auditQuery{Profile: "jane roe"}, ids: []string{"s3"}},
+		{name: "unknown profile", q: auditQuery{Profile: "nobody@example.com"}, ids: []string{}},
+		{name: "since", q: auditQuery{Since: "2024-02-03"}, ids: []string{"s2", "s3"}},
+		{name: "until", q: auditQuery{Until: "2024-02-03"}, ids: []string{"s1", "s2"}},
+		{name: "since and until", q: auditQuery{Since: "2024-02-01", Until: "2024-02-10"}, ids: []string{"s2"}},
+		{name: "sha prefix", q: auditQuery{SHA: "ccc"}, ids: []string{"s3"}},
+		{name: "invalid date", q: auditQuery{Since: "2024-13-01"}, err: "invalid date '2024-13-01', expected YYYY-MM-DD"},
+	}
+	for _, c := range cases {
+		entries, err := queryAudit(&c.q)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%s: got error %v, want %s", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		ids := []string{}
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(c.ids, ",") {
+			t.Errorf("%s: got %v, want %v", c.name, ids, c.ids)
+		}
+	}
+	entries, _ := queryAudit(&auditQuery{SHA: "bbb", Full: true})
+	if len(entries) != 1 || entries[0].Added != 1 || entries[0].Deleted != 1 || len(entries[0].Add) != 1 || len(entries[0].Del) != 1 ||
+		entries[0].Changes == nil || len(entries[0].Changes.Changed) != 1 {
+		t.Errorf("full entry: got %+v", entries)
+	}
+	entries, _ = queryAudit(&auditQuery{SHA: "bbb"})
+	if len(entries) != 1 || entries[0].Add != nil || entries[0].Del != nil {
+		t.Errorf("entry without full: got %+v", entries)
+	}
+}
+
+func TestReadAuditFile(t *testing.T) {
+	testAuditLog(t)
+	fn := filepath.Join(gCfg.DataDir, auditDir, "2024-02.jsonl")
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// record being written by the service
+	_, _ = f.WriteString(`{"id":"s4","time":"2024-02`)
+	_ = f.Close()
+	entries, err := queryAudit(&auditQuery{})
+	if err != nil || len(entries) != 3 {
+		t.Errorf("partial last line: got %d entries, error %v", len(entries), err)
+	}
+	if err := ioutil.WriteFile(fn, []byte("{\"id\":\"s2\"}\n\nnot json\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queryAudit(&auditQuery{}); err == nil || !strings.HasPrefix(err.Error(), fn+":3: ") {
+		t.Errorf("corrupt line: got error %v", err)
+	}
+	if _, err := findAudit("s1"); err == nil {
+		t.Errorf("findAudit ignored corrupt file")
+	}
+}
+
+func TestFindAudit(t *testing.T) {
+	testAuditLog(t)
+	rec, err := findAudit("s2")
+	if err != nil || rec.SHA != "bbb222" || rec.PR != 12 {
+		t.Errorf("got %+v, error %v", rec, err)
+	}
+	if _, err := findAudit("s9"); err == nil || err.Error() != "sync 's9' not found in audit log" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestHandleAudit(t *testing.T) {
+	testAuditLog(t)
+	var cases = []struct {
+		url  string
+		code int
+		ids  []string
+		full bool
+	}{
+		{url: "/audit", code: 200, ids: []string{"s1", "s2", "s3"}},
+		{url: "/audit?profile=jdoe&since=2024-02-01", code: 200, ids: []string{"s2"}},
+		{url: "/audit?sha=aaa&full=1", code: 200, ids: []string{"s1"}, full: true},
+		{url: "/audit?until=2023-12-31", code: 200, ids: []string{}},
+		{url: "/audit?since=yesterday", code: 400},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handleAudit(w, httptest.NewRequest("GET", c.url, nil))
+		if w.Code != c.code {
+			t.Errorf("%s: got status %d, want %d", c.url, w.Code, c.code)
+			continue
+		}
+		if c.code != 200 {
+			continue
+		}
+		var entries []*auditEntryOutput
+		if err := yaml.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+			t.Errorf("%s: %v", c.url, err)
+			continue
+		}
+		ids := []string{}
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+			if (len(entry.Add) > 0) != c.full {
+				t.Errorf("%s: %s has %d added profiles, want full %v", c.url, entry.ID, len(entry.Add), c.full)
+			}
+		}
+		if strings.Join(ids, ",") != strings.Join(c.ids, ",") {
+			t.Errorf("%s: got %v, want %v", c.url, ids, c.ids)
+		}
+	}
+}
+
+func TestAuditCommand(t *testing.T) {
+	testAuditLog(t)
+	var cases = []struct {
+		args []string
+		ok   bool
+		ids  []string
+	}{
+		{args: []string{"-"}, ok: true, ids: []string{"s1", "s2", "s3"}},
+		{args: []string{"john!example.com", "since", "2024-02-01"}, ok: true, ids: []string{"s2"}},
+		{args: []string{"-", "sha", "ccc", "full"}, ok: true, ids: []string{"s3"}},
+		{args: []string{"-", "until", "2024-01-31", "since", "2024-01-01"}, ok: true, ids: []string{"s1"}},
+		{args: []string{}},
+		{args: []string{"-", "since"}},
+		{args: []string{"-", "after", "2024-01-01"}},
+		{args: []string{"-", "since", "2024/01/01"}},
+	}
+	for _, c := range cases {
+		var ok bool
+		out := captureStdout(t, func() { ok = auditCommand(context.Background(), c.args) })
+		if ok != c.ok {
+			t.Errorf("%v: got ok %v, want %v", c.args, ok, c.ok)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		var entries []*auditEntryOutput
+		if err := yaml.Unmarshal([]byte(out), &entries); err != nil {
+			t.Errorf("%v: %v", c.args, err)
+			continue
+		}
+		ids := []string{}
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(c.ids, ",") {
+			t.Errorf("%v: got %v, want %v", c.args, ids, c.ids)
+		}
+	}
+}
+
+// captureStdout returns what fn prints to standard output
+func captureStdout(t *testing.T, fn func()) string {
+	saved := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		done <- data
+	}()
+	fn()
+	os.Stdout = saved
+	_ = w.Close()
+	return string(<-done)
+}
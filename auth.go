@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const maxWebhookPayload = 25 << 20
+
+// verifySignature checks GitHub's X-Hub-Signature-256 header: "sha256=" + hex(HMAC-SHA256(secret, body))
+func verifySignature(secret, signature string, body []byte) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// authenticate accepts GitHub webhook POSTs signed with GITDM_WEBHOOK_SECRET
+// and requests having "Authorization: Bearer GITDM_API_TOKEN" header (cron jobs, scripts)
+func authenticate(req *http.Request) (bool, string) {
+	signature := req.Header.Get("X-Hub-Signature-256")
+	if signature != "" {
+		if req.Method != http.MethodPost {
+			return false, "signed requests must use POST method"
+		}
+		secret := gCfg.WebhookSecret
+		if secret == "" {
+			return false, "webhook secret is not configured"
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxWebhookPayload+1))
+		_ = req.Body.Close()
+		if err != nil {
+			return false, "cannot read payload: " + err.Error()
+		}
+		if len(body) > maxWebhookPayload {
+			return false, "payload is too large"
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if !verifySignature(secret, signature, body) {
+			return false, "invalid webhook signature"
+		}
+		return true, "webhook"
+	}
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return false, "no credentials"
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false, "unsupported authorization scheme"
+	}
+	token := gCfg.APIToken
+	if token == "" {
+		return false, "API token is not configured"
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		return false, "invalid token"
+	}
+	return true, "token"
+}
+
+// authorized rejects unauthenticated requests before handler starts any git or DB work
+func authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		req = withRequestID(w, req)
+		ok, reason := authenticate(req)
+		if !ok {
+			logf(logFields{"request_id": requestID(req)}, levelWarn, "Unauthorized request: %s: %s\n", requestInfo(req), reason)
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, timeStampStr()+"unauthorized\n")
+			return
+		}
+		if req.Header.Get("X-GitHub-Event") == "ping" {
+			reqPrintf(req, "GitHub ping: %s\n", requestInfo(req))
+			w.WriteHeader(http.StatusOK)
+			_, _ = io.WriteString(w, "PONG")
+			return
+		}
+		reqPrintf(req, "Authorized request (%s): %s\n", reason, requestInfo(req))
+		handler(w, req)
+	}
+}
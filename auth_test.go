@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testSignature(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/master"}`)
+	valid := testSignature("s3cret", string(body))
+	var cases = []struct {
+		name      string
+		secret    string
+		signature string
+		ok        bool
+	}{
+		{name: "valid", secret: "s3cret", signature: valid, ok: true},
+		{name: "wrong secret", secret: "other", signature: valid},
+		{name: "wrong hmac", secret: "s3cret", signature: testSignature("s3cret", "other body")},
+		{name: "missing prefix", secret: "s3cret", signature: strings.TrimPrefix(valid, "sha256=")},
+		{name: "sha1 prefix", secret: "s3cret", signature: "sha1=" + strings.TrimPrefix(valid, "sha256=")},
+		{name: "not hex", secret: "s3cret", signature: "sha256=zz"},
+		{name: "truncated", secret: "s3cret", signature: valid[:len(valid)-2]},
+		{name: "empty", secret: "s3cret"},
+	}
+	for _, c := range cases {
+		if got := verifySignature(c.secret, c.signature, body); got != c.ok {
+			t.Errorf("%s: verifySignature = %v, want %v", c.name, got, c.ok)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	saved := gCfg
+	defer func() { gCfg = saved }()
+	body := `{"zen":"Keep it logically awesome."}`
+	large := strings.Repeat("x", maxWebhookPayload+1)
+	var cases = []struct {
+		name      string
+		method    string
+		body      string
+		secret    string
+		token     string
+		signature string
+		auth      string
+		ok        bool
+		reason    string
+	}{
+		{name: "valid signature", body: body, secret: "s3cret", signature: testSignature("s3cret", body), ok: true, reason: "webhook"},
+		{name: "wrong signature", body: body, secret: "s3cret", signature: testSignature("other", body), reason: "invalid webhook signature"},
+		{name: "signature without prefix", body: body, secret: "s3cret", signature: strings.TrimPrefix(testSignature("s3cret", body), "sha256="), reason: "invalid webhook signature"},
+		{name: "signed GET", method: http.MethodGet, secret: "s3cret", signature: testSignature("s3cret", ""), reason: "signed requests must use POST method"},
+		{name: "secret not configured", body: body, signature: testSignature("", body), reason: "webhook secret is not configured"},
+		{name: "payload too large", body: large, secret: "s3cret", signature: testSignature("s3cret", large), reason: "payload is too large"},
+		{name: "signature wins over token", body: body, secret: "s3cret", token: "tok", signature: "sha256=00", auth: "Bearer tok", reason: "invalid webhook signature"},
+		{name: "valid token", token: "tok", auth: "Bearer tok", ok: true, reason: "token"},
+		{name: "invalid token", token: "tok", auth: "Bearer tok2", reason: "invalid token"},
+		{name: "token prefix", token: "tok", auth: "Bearer to", reason: "invalid token"},
+		{name: "token not configured", auth: "Bearer ", reason: "API token is not configured"},
+		{name: "basic auth", token: "tok", auth: "Basic dG9r", reason: "unsupported authorization scheme"},
+		{name: "no credentials", token: "tok", reason: "no credentials"},
+	}
+	for _, c := range cases {
+		cfg := *saved
+		cfg.WebhookSecret, cfg.APIToken = c.secret, c.token
+		gCfg = &cfg
+		method := c.method
+		if method == "" {
+			method = http.MethodPost
+		}
+		req := httptest.NewRequest(method, "/webhook", strings.NewReader(c.body))
+		if c.signature != "" {
+			req.Header.Set("X-Hub-Signature-256", c.signature)
+		}
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		ok, reason := authenticate(req)
+		if ok != c.ok || reason != c.reason {
+			t.Errorf("%s: got %v (%s), want %v (%s)", c.name, ok, reason, c.ok, c.reason)
+		}
+	}
+}
+
+func TestAuthorizedHandlerReadsBody(t *testing.T) {
+	saved := gCfg
+	defer func() { gCfg = saved }()
+	cfg := *saved
+	cfg.WebhookSecret, cfg.APIToken = "s3cret", "tok"
+	gCfg = &cfg
+	body := `{"action":"opened","number":7}`
+	var got string
+	handler := authorized(func(w http.ResponseWriter, req *http.Request) {
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = string(data)
+		_, _ = io.WriteString(w, "OK")
+	})
+	var cases = []struct {
+		name      string
+		signature string
+		event     string
+		status    int
+		body      string
+	}{
+		{name: "signed", signature: testSignature("s3cret", body), event: "pull_request", status: http.StatusOK, body: body},
+		{name: "bad signature", signature: testSignature("other", body), event: "pull_request", status: http.StatusUnauthorized},
+		{name: "ping", signature: testSignature("s3cret", body), event: "ping", status: http.StatusOK},
+	}
+	for _, c := range cases {
+		got = ""
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature-256", c.signature)
+		req.Header.Set("X-GitHub-Event", c.event)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != c.status || got != c.body {
+			t.Errorf("%s: got status %d and body %q in handler, want %d and %q", c.name, w.Code, got, c.status, c.body)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const defaultCommitMessage = `{{.User}} gitdm-sync @ {{.Time}}
+
+Trigger: {{.Trigger}}{{if .Caller}}, caller: {{.Caller}}{{end}}{{if .PR}}, PR #{{.PR}}{{end}}
+Profiles: {{.Profiles}}, added: {{.Added}}, removed: {{.Removed}}`
+
+// mergedPRRE extracts PR number from GitHub merge and squash merge commit messages
+var mergedPRRE = regexp.MustCompile(`^Merge pull request #([0-9]+)|\(#([0-9]+)\)\s*$`)
+
+// commitInfo describes what triggered a bot commit, it is available in commit message template
+type commitInfo struct {
+	Trigger  string
+	Caller   string
+	PR       int64
+	User     string
+	Time     string
+	Profiles int
+	Added    int
+	Removed  int
+	// Branch is the branch commit is pushed to, SHA is set once commit is created
+	Branch string
+	SHA    string
+}
+
+func newCommitInfo(trigger, caller string) *commitInfo {
+	return &commitInfo{Trigger: trigger, Caller: caller, Branch: gCfg.Branch}
+}
+
+// mergedPR returns PR number merged by a commit with a given message, 0 when not a PR merge
+func mergedPR(message string) int64 {
+	firstLine := strings.SplitN(message, "\n", 2)[0]
+	m := mergedPRRE.FindStringSubmatch(firstLine)
+	if m == nil {
+		return 0
+	}
+	n := m[1]
+	if n == "" {
+		n = m[2]
+	}
+	pr, _ := strconv.ParseInt(n, 10, 64)
+	return pr
+}
+
+// countChanges sets numbers of added and removed profiles between old and new profiles lists
+func (c *commitInfo) countChanges(oldProfs, newProfs []*allOutput) {
+	newKeys := make([]string, len(newProfs))
+	for i, prof := range newProfs {
+		newKeys[i] = prof.sortKey()
+	}
+	c.countKeys(oldProfs, newKeys)
+}
+
+// countKeys is countChanges for new profiles given by their sort keys, it is used when they are not held in memory
+func (c *commitInfo) countKeys(oldProfs []*allOutput, newKeys []string) {
+	old := make(map[string]struct{}, len(oldProfs))
+	for _, prof := range oldProfs {
+		old[prof.sortKey()] = struct{}{}
+	}
+	c.Added, c.Removed = 0, 0
+	for _, key := range newKeys {
+		if _, ok := old[key]; ok {
+			delete(old, key)
+			continue
+		}
+		c.Added++
+	}
+	c.Removed = len(old)
+	c.Profiles = len(newKeys)
+}
+
+// render executes commit message template using info
+func (c *commitInfo) render(tmpl string) (string, error) {
+	t, err := template.New("commit").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, c)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// message renders configured commit message template
+func (c *commitInfo) message() (string, error) {
+	c.User = gCfg.GitHubUser
+	c.Time = time.Now().Format(dateTimeFormat)
+	return c.render(gCfg.CommitMessage)
+}
+
+// commitCommand returns git commit command using configured identity and signing, without touching any git config
+func commitCommand(msg string) []string {
+	cmd := []string{"git", "-c", "user.name=" + gCfg.GitUser, "-c", "user.email=" + gCfg.GitEmail}
+	var sign []string
+	switch gCfg.SignCommits {
+	case "gpg":
+		cmd = append(cmd, "-c", "gpg.format=openpgp", "-c", "user.signingkey="+gCfg.SigningKey)
+		sign = []string{"-S"}
+	case "ssh":
+		cmd = append(cmd, "-c", "gpg.format=ssh", "-c", "user.signingkey="+gCfg.SigningKey)
+		sign = []string{"-S"}
+	}
+	cmd = append(append(cmd, "commit", "-s"), sign...)
+	return append(cmd, "-m", msg)
+}
+
+// validateCommitConfig returns commit related configuration errors
+func (c *config) validateCommitConfig() (errs []string) {
+	if _, err := (&commitInfo{}).render(c.CommitMessage); err != nil {
+		errs = append(errs, fmt.Sprintf("commit_message: %v", err))
+	}
+	switch c.SignCommits {
+	case "none":
+	case "gpg", "ssh":
+		if c.SigningKey == "" {
+			errs = append(errs, fmt.Sprintf("signing_key must be set when sign_commits is '%s'", c.SignCommits))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("sign_commits '%s': must be one of none, gpg, ssh", c.SignCommits))
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommitMessageTemplate(t *testing.T) {
+	info := &commitInfo{
+		Trigger: "pr", Caller: "jdoe", PR: 42, User: "gitdm-bot", Time: "2024-01-02 03:04:05",
+		Profiles: 1000, Added: 3, Removed: 2,
+	}
+	var cases = []struct {
+		tmpl string
+		want string
+		err  bool
+	}{
+		{tmpl: "{{.User}}", want: "gitdm-bot"},
+		{tmpl: "{{.Time}}", want: "2024-01-02 03:04:05"},
+		{tmpl: "{{.Trigger}}", want: "pr"},
+		{tmpl: "{{.Caller}}", want: "jdoe"},
+		{tmpl: "{{.PR}}", want: "42"},
+		{tmpl: "{{.Profiles}}", want: "1000"},
+		{tmpl: "{{.Added}}", want: "3"},
+		{tmpl: "{{.Removed}}", want: "2"},
+		{tmpl: "  {{.Added}}+{{.Removed}}\n\n", want: "3+2"},
+		{
+			tmpl: defaultCommitMessage,
+			want: "gitdm-bot gitdm-sync @ 2024-01-02 03:04:05\n\nTrigger: pr, caller: jdoe, PR #42\nProfiles: 1000, added: 3, removed: 2",
+		},
+		{tmpl: "{{.Unknown}}", err: true},
+		{tmpl: "{{.User", err: true},
+	}
+	for _, c := range cases {
+		got, err := info.render(c.tmpl)
+		if (err != nil) != c.err {
+			t.Errorf("%q: got error %v, want error %v", c.tmpl, err, c.err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%q: got %q, want %q", c.tmpl, got, c.want)
+		}
+	}
+	got, _ := (&commitInfo{Trigger: "push", Profiles: 10, Added: 1}).render(defaultCommitMessage)
+	if want := "Trigger: push\nProfiles: 10, added: 1, removed: 0"; !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, want optional fields omitted: %q", got, want)
+	}
+}
+
+func TestCommitInfoMessage(t *testing.T) {
+	saved := gCfg
+	defer func() { gCfg = saved }()
+	cfg := *saved
+	cfg.GitHubUser, cfg.CommitMessage = "gitdm-bot", "{{.User}} {{.Time}}"
+	gCfg = &cfg
+	got, err := newCommitInfo("push", "").message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.SplitN(got, " ", 2)
+	if len(fields) != 2 || fields[0] != "gitdm-bot" {
+		t.Fatalf("got %q", got)
+	}
+	if _, err := time.Parse(dateTimeFormat, fields[1]); err != nil {
+		t.Errorf("got time %q: %v", fields[1], err)
+	}
+}
+
+func TestCommitCommand(t *testing.T) {
+	saved := gCfg
+	defer func() { gCfg = saved }()
+	var cases = []struct {
+		sign string
+		want string
+	}{
+		{sign: "none", want: "git -c user.name=Bot -c user.email=bot@a.com commit -s -m msg"},
+		{sign: "", want: "git -c user.name=Bot -c user.email=bot@a.com commit -s -m msg"},
+		{
+			sign: "gpg",
+			want: "git -c user.name=Bot -c user.email=bot@a.com -c gpg.format=openpgp -c user.signingkey=KEY commit -s -S -m msg",
+		},
+		{
+			sign: "ssh",
+			want: "git -c user.name=Bot -c user.email=bot@a.com -c gpg.format=ssh -c user.signingkey=KEY commit -s -S -m msg",
+		},
+	}
+	for _, c := range cases {
+		cfg := *saved
+		cfg.GitUser, cfg.GitEmail, cfg.SignCommits, cfg.SigningKey = "Bot", "bot@a.com", c.sign, "KEY"
+		gCfg = &cfg
+		if got := strings.Join(commitCommand("msg"), " "); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.sign, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// config holds effective service configuration: defaults, overridden by GITDM_CONFIG YAML file,
+// overridden by <ENV>_FILE files contents (Kubernetes secret mounts), overridden by <ENV> variables,
+// fields tagged required:"serve" must be set to run the service, secret:"1" values are redacted in all outputs
+type config struct {
+	ListenAddr          string        `yaml:"listen_addr" env:"GITDM_LISTEN_ADDR"`
+	LogLevel            string        `yaml:"log_level" env:"GITDM_LOG_LEVEL"`
+	LogFormat           string        `yaml:"log_format" env:"GITDM_LOG_FORMAT"`
+	Branch              string        `yaml:"branch" env:"GITDM_BRANCH"`
+	ProfilesPattern     string        `yaml:"profiles_pattern" env:"GITDM_PROFILES_PATTERN"`
+	ShardSize           int           `yaml:"shard_size" env:"GITDM_SHARD_SIZE"`
+	SortRunSize         int           `yaml:"sort_run_size" env:"GITDM_SORT_RUN_SIZE"`
+	Workers             int           `yaml:"workers" env:"GITDM_WORKERS"`
+	Transliterate       bool          `yaml:"transliterate" env:"GITDM_TRANSLITERATE"`
+	HTTPTimeout         time.Duration `yaml:"http_timeout" env:"GITDM_HTTP_TIMEOUT"`
+	CommandTimeout      time.Duration `yaml:"command_timeout" env:"GITDM_COMMAND_TIMEOUT"`
+	ReadTimeout         time.Duration `yaml:"read_timeout" env:"GITDM_READ_TIMEOUT"`
+	WriteTimeout        time.Duration `yaml:"write_timeout" env:"GITDM_WRITE_TIMEOUT"`
+	CloneTimeout        time.Duration `yaml:"clone_timeout" env:"GITDM_CLONE_TIMEOUT"`
+	ParseTimeout        time.Duration `yaml:"parse_timeout" env:"GITDM_PARSE_TIMEOUT"`
+	ValidateTimeout     time.Duration `yaml:"validate_timeout" env:"GITDM_VALIDATE_TIMEOUT"`
+	WriteFilesTimeout   time.Duration `yaml:"write_files_timeout" env:"GITDM_WRITE_FILES_TIMEOUT"`
+	PushTimeout         time.Duration `yaml:"push_timeout" env:"GITDM_PUSH_TIMEOUT"`
+	APITimeout          time.Duration `yaml:"api_timeout" env:"GITDM_API_TIMEOUT"`
+	ReadyCheckInterval  time.Duration `yaml:"ready_check_interval" env:"GITDM_READY_CHECK_INTERVAL"`
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period" env:"GITDM_SHUTDOWN_GRACE_PERIOD"`
+	DriftCheckInterval  time.Duration `yaml:"drift_check_interval" env:"GITDM_DRIFT_CHECK_INTERVAL"`
+	DAAPIURL            string        `yaml:"da_api_url" env:"DA_API_URL" required:"serve"`
+	Auth0URL            string        `yaml:"auth0_url" env:"AUTH0_URL" required:"serve"`
+	Auth0Audience       string        `yaml:"auth0_audience" env:"AUTH0_AUDIENCE" required:"serve"`
+	Auth0ClientID       string        `yaml:"auth0_client_id" env:"AUTH0_CLIENT_ID" required:"serve"`
+	Auth0ClientSecret   string        `yaml:"auth0_client_secret" env:"AUTH0_CLIENT_SECRET" required:"serve" secret:"1"`
+	JWTToken            string        `yaml:"jwt_token" env:"JWT_TOKEN" secret:"1"`
+	GitHubRepo          string        `yaml:"github_repo" env:"GITDM_GITHUB_REPO" required:"serve"`
+	GitHubUser          string        `yaml:"github_user" env:"GITDM_GITHUB_USER" required:"serve"`
+	GitHubOAuth         string        `yaml:"github_oauth" env:"GITDM_GITHUB_OAUTH" required:"serve" secret:"1"`
+	GitUser             string        `yaml:"git_user" env:"GITDM_GIT_USER" required:"serve"`
+	GitEmail            string        `yaml:"git_email" env:"GITDM_GIT_EMAIL" required:"serve"`
+	CommitMessage       string        `yaml:"commit_message" env:"GITDM_COMMIT_MESSAGE"`
+	SignCommits         string        `yaml:"sign_commits" env:"GITDM_SIGN_COMMITS"`
+	SigningKey          string        `yaml:"signing_key" env:"GITDM_SIGNING_KEY"`
+	PushRetries         int           `yaml:"push_retries" env:"GITDM_PUSH_RETRIES"`
+	DataDir             string        `yaml:"data_dir" env:"GITDM_DATA_DIR"`
+	SnapshotsKeep       int           `yaml:"snapshots_keep" env:"GITDM_SNAPSHOTS_KEEP"`
+	HistoryCacheKeep    int           `yaml:"history_cache_keep" env:"GITDM_HISTORY_CACHE_KEEP"`
+	DBSyncMode          string        `yaml:"db_sync_mode" env:"GITDM_DB_SYNC_MODE"`
+	DBSyncBranch        string        `yaml:"db_sync_branch" env:"GITDM_DB_SYNC_BRANCH"`
+	DBSyncAutoMerge     int           `yaml:"db_sync_auto_merge" env:"GITDM_DB_SYNC_AUTO_MERGE"`
+	APIToken            string        `yaml:"api_token" env:"GITDM_API_TOKEN" required:"serve" secret:"1"`
+	WebhookSecret       string        `yaml:"webhook_secret" env:"GITDM_WEBHOOK_SECRET" secret:"1"`
+	GitHubAPIURL        string        `yaml:"github_api_url" env:"GITDM_GITHUB_API_URL"`
+	GitHubReport        string        `yaml:"github_report" env:"GITDM_GITHUB_REPORT"`
+	GitHubChecksToken   string        `yaml:"github_checks_token" env:"GITDM_GITHUB_CHECKS_TOKEN" secret:"1"`
+	GitHubStatusURL     string        `yaml:"github_status_url" env:"GITDM_GITHUB_STATUS_URL"`
+}
+
+var gCfg = defaultConfig()
+
+func defaultConfig() *config {
+	return &config{
+		ListenAddr:          "0.0.0.0:7070",
+		LogLevel:            levelInfo,
+		Branch:              "master",
+		ProfilesPattern:     "profiles%d.yaml",
+		ShardSize:           1 << 20,
+		SortRunSize:         50000,
+		Workers:             runtime.NumCPU(),
+		Transliterate:       true,
+		HTTPTimeout:         5 * time.Minute,
+		CommandTimeout:      10 * time.Minute,
+		ReadTimeout:         time.Minute,
+		WriteTimeout:        45 * time.Minute,
+		CloneTimeout:        5 * time.Minute,
+		ParseTimeout:        5 * time.Minute,
+		ValidateTimeout:     5 * time.Minute,
+		WriteFilesTimeout:   5 * time.Minute,
+		PushTimeout:         5 * time.Minute,
+		APITimeout:          10 * time.Minute,
+		ReadyCheckInterval:  time.Minute,
+		ShutdownGracePeriod: 2 * time.Minute,
+		GitHubAPIURL:        "https://api.github.com",
+		GitHubReport:        "status",
+		CommitMessage:       defaultCommitMessage,
+		SignCommits:         "none",
+		PushRetries:         3,
+		DataDir:             "data",
+		SnapshotsKeep:       30,
+		HistoryCacheKeep:    200,
+		DBSyncMode:          "push",
+		DBSyncBranch:        "gitdm-sync/db",
+	}
+}
+
+// setField sets config field from string value found in env variable or file
+func setField(f reflect.Value, value string) error {
+	value = strings.TrimSpace(value)
+	if f.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported config field type %v", f.Type())
+	}
+	return nil
+}
+
+// applyEnv overrides config values using <ENV>_FILE files and <ENV> variables
+func (c *config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		env := t.Field(i).Tag.Get("env")
+		if fn := os.Getenv(env + "_FILE"); fn != "" {
+			data, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return errors.Wrap(err, env+"_FILE")
+			}
+			if err = setField(v.Field(i), string(data)); err != nil {
+				return errors.Wrap(err, env+"_FILE")
+			}
+		}
+		if value, ok := os.LookupEnv(env); ok && value != "" {
+			if err := setField(v.Field(i), value); err != nil {
+				return errors.Wrap(err, env)
+			}
+		}
+	}
+	return nil
+}
+
+// validate returns configuration errors, serve enables checking settings required to run the service
+func (c *config) validate(serve bool) (errs []string) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	if serve {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.Tag.Get("required") == "serve" && v.Field(i).String() == "" {
+				errs = append(errs, fmt.Sprintf("%s (%s env variable) must be set", field.Tag.Get("yaml"), field.Tag.Get("env")))
+			}
+		}
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Sprintf("listen_addr '%s': %v", c.ListenAddr, err))
+	}
+	if c.Branch == "" || strings.ContainsAny(c.Branch, " \t:~^?*[\\") {
+		errs = append(errs, fmt.Sprintf("branch '%s': invalid branch name", c.Branch))
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		errs = append(errs, fmt.Sprintf("log_level '%s': must be one of debug, info, warn, error", c.LogLevel))
+	}
+	switch c.LogFormat {
+	case "", "json", "text":
+	default:
+		errs = append(errs, fmt.Sprintf("log_format '%s': must be one of json, text", c.LogFormat))
+	}
+	switch c.DBSyncMode {
+	case "push":
+	case "pr":
+		if c.DBSyncBranch == "" || c.DBSyncBranch == c.Branch || strings.ContainsAny(c.DBSyncBranch, " \t:~^?*[\\") {
+			errs = append(errs, fmt.Sprintf("db_sync_branch '%s': invalid branch name or the same as branch", c.DBSyncBranch))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("db_sync_mode '%s': must be one of push, pr", c.DBSyncMode))
+	}
+	if c.PushRetries < 0 {
+		errs = append(errs, fmt.Sprintf("push_retries %d: must not be negative", c.PushRetries))
+	}
+	if c.DBSyncAutoMerge < 0 {
+		errs = append(errs, fmt.Sprintf("db_sync_auto_merge %d: must not be negative", c.DBSyncAutoMerge))
+	}
+	if strings.Count(c.ProfilesPattern, "%") != 1 || strings.Count(c.ProfilesPattern, "%d") != 1 || strings.Contains(c.ProfilesPattern, "/") {
+		errs = append(errs, fmt.Sprintf("profiles_pattern '%s': must be a file name containing a single %%d", c.ProfilesPattern))
+	}
+	if c.ShardSize < 1024 {
+		errs = append(errs, fmt.Sprintf("shard_size %d: must be at least 1024 bytes", c.ShardSize))
+	}
+	if c.DriftCheckInterval < 0 {
+		errs = append(errs, fmt.Sprintf("drift_check_interval %v: must not be negative", c.DriftCheckInterval))
+	}
+	if c.Workers < 1 {
+		errs = append(errs, fmt.Sprintf("workers %d: must be positive", c.Workers))
+	}
+	if c.SortRunSize < 1 {
+		errs = append(errs, fmt.Sprintf("sort_run_size %d: must be positive", c.SortRunSize))
+	}
+	if c.SnapshotsKeep < 1 {
+		errs = append(errs, fmt.Sprintf("snapshots_keep %d: must be positive", c.SnapshotsKeep))
+	}
+	if c.HistoryCacheKeep < 1 {
+		errs = append(errs, fmt.Sprintf("history_cache_keep %d: must be positive", c.HistoryCacheKeep))
+	}
+	for name, d := range map[string]time.Duration{
+		"http_timeout":          c.HTTPTimeout,
+		"command_timeout":       c.CommandTimeout,
+		"read_timeout":          c.ReadTimeout,
+		"write_timeout":         c.WriteTimeout,
+		"clone_timeout":         c.CloneTimeout,
+		"parse_timeout":         c.ParseTimeout,
+		"validate_timeout":      c.ValidateTimeout,
+		"write_files_timeout":   c.WriteFilesTimeout,
+		"push_timeout":          c.PushTimeout,
+		"api_timeout":           c.APITimeout,
+		"ready_check_interval":  c.ReadyCheckInterval,
+		"shutdown_grace_period": c.ShutdownGracePeriod,
+	} {
+		if d <= 0 {
+			errs = append(errs, fmt.Sprintf("%s %v: must be positive", name, d))
+		}
+	}
+	if d := c.jobTimeout(); c.WriteTimeout < d {
+		errs = append(errs, fmt.Sprintf("write_timeout %v: must be at least %v, the sum of phase timeouts (sort and write phases both use write_files_timeout)", c.WriteTimeout, d))
+	}
+	for name, u := range map[string]string{"da_api_url": c.DAAPIURL, "auth0_url": c.Auth0URL, "github_api_url": c.GitHubAPIURL} {
+		if u == "" {
+			continue
+		}
+		pu, err := url.Parse(os.ExpandEnv(u))
+		if err != nil || pu.Scheme == "" || pu.Host == "" {
+			errs = append(errs, fmt.Sprintf("%s '%s': invalid URL", name, u))
+		}
+	}
+	switch c.GitHubReport {
+	case "status", "check", "none":
+	default:
+		errs = append(errs, fmt.Sprintf("github_report '%s': must be one of status, check, none", c.GitHubReport))
+	}
+	errs = append(errs, c.validateCommitConfig()...)
+	return
+}
+
+// secrets returns all non-empty secret config values
+func (c *config) secrets() (values []string) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("secret") != "" && v.Field(i).String() != "" {
+			values = append(values, v.Field(i).String())
+		}
+	}
+	return
+}
+
+// effective returns config as YAML with secret values replaced by "***" (or "" when not set)
+func (c *config) effective() ([]byte, error) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	m := yaml.MapSlice{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		var value interface{} = v.Field(i).Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if field.Tag.Get("secret") != "" && v.Field(i).String() != "" {
+			value = redacted
+		}
+		m = append(m, yaml.MapItem{Key: field.Tag.Get("yaml"), Value: value})
+	}
+	return yaml.Marshal(m)
+}
+
+// loadConfig reads configuration, serve enables checking settings required to run the service
+func loadConfig(ctx context.Context, serve bool) (*config, bool) {
+	cfg := defaultConfig()
+	fn := os.Getenv("GITDM_CONFIG")
+	if fn != "" {
+		mPrintf(ctx, "reading config %s\n", fn)
+		data, err := ioutil.ReadFile(fn)
+		if fatalOnError(ctx, err, false) {
+			return nil, false
+		}
+		err = yaml.UnmarshalStrict(data, cfg)
+		if err != nil {
+			fatalOnError(ctx, errors.Wrap(err, fn), false)
+			return nil, false
+		}
+	}
+	if fatalOnError(ctx, cfg.applyEnv(), false) {
+		return nil, false
+	}
+	// jobs run inside the cloned repo directory, so data directory must not be relative
+	dataDir, err := filepath.Abs(cfg.DataDir)
+	if fatalOnError(ctx, err, false) {
+		return nil, false
+	}
+	cfg.DataDir = dataDir
+	// service logs are collected as JSON lines, CLI commands log text by default
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = "text"
+		if serve {
+			cfg.LogFormat = "json"
+		}
+	}
+	errs := cfg.validate(serve)
+	if len(errs) > 0 {
+		fatalf(ctx, false, "%d configuration error(s):\n%s", len(errs), strings.Join(errs, "\n"))
+		return nil, false
+	}
+	return cfg, true
+}
+
+// profilesFile returns name of n-th (1-based) profiles shard file
+func (c *config) profilesFile(n int) string {
+	return fmt.Sprintf(c.ProfilesPattern, n)
+}
+
+// profilesGlob returns git pathspec matching all profile shard files
+func (c *config) profilesGlob() string {
+	return strings.Replace(c.ProfilesPattern, "%d", "*", 1)
+}
+
+func handleConfig(w http.ResponseWriter, req *http.Request) {
+	data, err := gCfg.effective()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, timeStampStr()+err.Error()+"\n")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
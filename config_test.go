@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateWriteTimeout(t *testing.T) {
+	var cases = []struct {
+		name  string
+		apply func(c *config)
+		ok    bool
+	}{
+		{name: "defaults", apply: func(c *config) {}, ok: true},
+		{name: "equal to sum", apply: func(c *config) { c.WriteTimeout = c.jobTimeout() }, ok: true},
+		{name: "old default", apply: func(c *config) { c.WriteTimeout = 30 * time.Minute }},
+		{name: "longer write files phase", apply: func(c *config) { c.WriteFilesTimeout = 10 * time.Minute }},
+	}
+	for _, c := range cases {
+		cfg := defaultConfig()
+		c.apply(cfg)
+		failed := false
+		for _, err := range cfg.validate(false) {
+			if strings.HasPrefix(err, "write_timeout") {
+				failed = true
+			}
+		}
+		if failed == c.ok {
+			t.Errorf("%s: write_timeout %v with phases taking %v accepted = %v, want %v", c.name, cfg.WriteTimeout, cfg.jobTimeout(), !failed, c.ok)
+		}
+	}
+	if d := defaultConfig().jobTimeout(); d != 40*time.Minute {
+		t.Errorf("default phase timeouts sum to %v, want 40m", d)
+	}
+}
+
+func TestLoadConfigEnvFiles(t *testing.T) {
+	var cases = []struct {
+		name  string
+		yaml  string
+		env   map[string]string
+		files map[string]string
+		check func(c *config) bool
+		err   string
+	}{
+		{
+			name:  "file",
+			files: map[string]string{"GITDM_API_TOKEN": "from-file"},
+			check: func(c *config) bool { return c.APIToken == "from-file" },
+		},
+		{
+			name:  "trailing newline trimmed",
+			files: map[string]string{"GITDM_API_TOKEN": "from-file\n", "GITDM_PUSH_RETRIES": "7\r\n", "GITDM_PUSH_TIMEOUT": "3m\n"},
+			check: func(c *config) bool {
+				return c.APIToken == "from-file" && c.PushRetries == 7 && c.PushTimeout == 3*time.Minute
+			},
+		},
+		{
+			name:  "variable overrides file",
+			env:   map[string]string{"GITDM_API_TOKEN": "from-env"},
+			files: map[string]string{"GITDM_API_TOKEN": "from-file\n"},
+			check: func(c *config) bool { return c.APIToken == "from-env" },
+		},
+		{
+			name:  "empty variable does not override file",
+			env:   map[string]string{"GITDM_API_TOKEN": ""},
+			files: map[string]string{"GITDM_API_TOKEN": "from-file"},
+			check: func(c *config) bool { return c.APIToken == "from-file" },
+		},
+		{
+			name:  "file and variable for different settings",
+			env:   map[string]string{"GITDM_BRANCH": "main"},
+			files: map[string]string{"GITDM_WEBHOOK_SECRET": "hook\n"},
+			check: func(c *config) bool { return c.Branch == "main" && c.WebhookSecret == "hook" },
+		},
+		{
+			name:  "YAML merged with env",
+			yaml:  "branch: develop\nworkers: 3\napi_token: from-yaml\nwebhook_secret: from-yaml\n",
+			env:   map[string]string{"GITDM_WORKERS": "5"},
+			files: map[string]string{"GITDM_API_TOKEN": "from-file"},
+			check: func(c *config) bool {
+				return c.Branch == "develop" && c.Workers == 5 && c.APIToken == "from-file" && c.WebhookSecret == "from-yaml" && c.ShardSize == defaultConfig().ShardSize
+			},
+		},
+		{
+			name: "missing file",
+			env:  map[string]string{"GITDM_API_TOKEN_FILE": "/nonexistent/api_token"},
+			err:  "GITDM_API_TOKEN_FILE: open /nonexistent/api_token: no such file or directory",
+		},
+		{
+			name:  "invalid file value",
+			files: map[string]string{"GITDM_PUSH_RETRIES": "many\n"},
+			err:   "GITDM_PUSH_RETRIES_FILE: strconv.Atoi: parsing \"many\": invalid syntax",
+		},
+		{
+			name: "invalid variable value",
+			env:  map[string]string{"GITDM_PUSH_TIMEOUT": "soon"},
+			err:  "GITDM_PUSH_TIMEOUT: time: invalid duration \"soon\"",
+		},
+	}
+	ctx := context.Background()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("GITDM_CONFIG", "")
+			for env, value := range c.env {
+				t.Setenv(env, value)
+			}
+			for env, value := range c.files {
+				fn := filepath.Join(dir, strings.ToLower(env))
+				if err := os.WriteFile(fn, []byte(value), 0600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv(env+"_FILE", fn)
+			}
+			if c.yaml != "" {
+				fn := filepath.Join(dir, "config.yaml")
+				if err := os.WriteFile(fn, []byte(c.yaml), 0600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("GITDM_CONFIG", fn)
+			}
+			if c.err != "" {
+				err := defaultConfig().applyEnv()
+				if err == nil || err.Error() != c.err {
+					t.Errorf("got error %v, want %s", err, c.err)
+				}
+				if _, ok := loadConfig(ctx, false); ok {
+					t.Errorf("config loaded, want error")
+				}
+				return
+			}
+			cfg, ok := loadConfig(ctx, false)
+			if !ok {
+				t.Fatal("config not loaded")
+			}
+			if !c.check(cfg) {
+				t.Errorf("got unexpected config %+v", cfg)
+			}
+		})
+	}
+}
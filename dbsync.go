@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// dbSyncPRBody returns rolling DB sync PR description with semantic summary of changes
+func dbSyncPRBody(info *commitInfo, diff *profilesDiffOutput) string {
+	return fmt.Sprintf(
+		"DB sync requested by `%s` @ %s, commit %s.\n\nThis PR is updated by every DB sync until it is merged or closed.\n\n%s",
+		info.Caller,
+		time.Now().Format(dateTimeFormat),
+		info.SHA,
+		diff.markdown(),
+	)
+}
+
+// syncFromDBWithPR pushes DB state to the bot branch and opens or updates a single rolling PR against the main branch,
+// PR is merged automatically when at most db_sync_auto_merge profiles changed, it is closed when DB matches the main branch
+func syncFromDBWithPR(ctx context.Context, info *commitInfo, profsYAML, profsDB []*allOutput) bool {
+	return dbSyncPR(ctx, newGitHubClient(ctx, gCfg.GitHubOAuth), info, profsYAML, profsDB)
+}
+
+func dbSyncPR(ctx context.Context, api githubAPI, info *commitInfo, profsYAML, profsDB []*allOutput) bool {
+	diff := diffProfiles(profsYAML, profsDB)
+	mPrintf(ctx, "DB sync changes: %s\n", diff)
+	info.Branch = gCfg.DBSyncBranch
+	write := func() bool {
+		return writeProfiles(ctx, profsDB)
+	}
+	if !checkProfiles(ctx, info, write, nil) || !jobPhase(ctx, phaseAPI) {
+		return false
+	}
+	pr, err := api.findPullRequest(info.Branch)
+	if fatalOnError(ctx, err, false) {
+		return false
+	}
+	if info.SHA == "" {
+		if pr != nil {
+			mPrintf(ctx, "DB matches %s, closing PR #%d\n", gCfg.Branch, pr.Number)
+			err = api.updatePullRequest(pr.Number, &githubPullRequestInput{State: "closed"})
+			if fatalOnError(ctx, err, false) {
+				return false
+			}
+		}
+		mPrintf(ctx, "processing repo finished\n")
+		return true
+	}
+	title := "gitdm-sync: DB sync, " + diff.String()
+	body := dbSyncPRBody(info, diff)
+	if pr == nil {
+		pr, err = api.createPullRequest(&githubPullRequestInput{Title: title, Body: body, Head: info.Branch, Base: gCfg.Branch})
+		if fatalOnError(ctx, err, false) {
+			return false
+		}
+		mPrintf(ctx, "opened DB sync PR #%d %s\n", pr.Number, pr.HTMLURL)
+	} else {
+		err = api.updatePullRequest(pr.Number, &githubPullRequestInput{Title: title, Body: body})
+		if fatalOnError(ctx, err, false) {
+			return false
+		}
+		mPrintf(ctx, "updated DB sync PR #%d %s\n", pr.Number, pr.HTMLURL)
+	}
+	if gCfg.DBSyncAutoMerge > 0 && diff.size() <= gCfg.DBSyncAutoMerge {
+		msg, err := info.message()
+		if fatalOnError(ctx, err, false) {
+			return false
+		}
+		mPrintf(ctx, "%d profiles changed (limit %d), auto merging PR #%d\n", diff.size(), gCfg.DBSyncAutoMerge, pr.Number)
+		err = api.mergePullRequest(
+			pr.Number,
+			&githubMergeInput{CommitTitle: strings.SplitN(msg, "\n", 2)[0], MergeMethod: "squash", SHA: info.SHA},
+		)
+		if fatalOnError(ctx, err, false) {
+			return false
+		}
+	}
+	mPrintf(ctx, "processing repo finished\n")
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDBSyncPR(t *testing.T) {
+	profiles := func(names ...string) (profs []*allOutput) {
+		for _, name := range names {
+			profs = append(profs, testProfile(name, strings.ToLower(name)+"@a.com", ""))
+		}
+		return
+	}
+	open := &githubPullRequest{Number: 12, HTMLURL: "https://github.com/o/r/pull/12"}
+	var cases = []struct {
+		name      string
+		db        []string
+		pr        *githubPullRequest
+		autoMerge int
+		opened    bool
+		edited    string
+		merged    bool
+		pushed    bool
+	}{
+		{name: "new PR", db: []string{"A", "B", "C"}, opened: true, pushed: true},
+		{name: "update PR", db: []string{"A", "B", "C"}, pr: open, edited: "open", pushed: true},
+		{name: "close PR without diff", db: []string{"A", "B"}, pr: open, edited: "closed"},
+		{name: "no diff and no PR", db: []string{"A", "B"}},
+		{name: "auto merge", db: []string{"A", "B", "C"}, autoMerge: 1, opened: true, merged: true, pushed: true},
+		{name: "auto merge existing PR", db: []string{"A", "C"}, pr: open, autoMerge: 2, edited: "open", merged: true, pushed: true},
+		{name: "above auto merge limit", db: []string{"A", "B", "C", "D"}, autoMerge: 1, opened: true, pushed: true},
+	}
+	for _, c := range cases {
+		bare := testGitRepo(t, profiles("A", "B"))
+		gCfg.DBSyncBranch, gCfg.DBSyncAutoMerge = "gitdm-sync/db", c.autoMerge
+		api := &stubGitHub{}
+		if c.pr != nil {
+			pr := *c.pr
+			api.pr = &pr
+		}
+		info := newCommitInfo("db", "jdoe")
+		if !dbSyncPR(context.Background(), api, info, profiles("A", "B"), profiles(c.db...)) {
+			t.Errorf("%s: DB sync failed", c.name)
+			continue
+		}
+		if len(api.branches) != 1 || api.branches[0] != "gitdm-sync/db" {
+			t.Errorf("%s: got PR lookups for %v", c.name, api.branches)
+		}
+		if (info.SHA != "") != c.pushed {
+			t.Errorf("%s: got pushed commit %q, want pushed %v", c.name, info.SHA, c.pushed)
+		}
+		if c.pushed {
+			if sha := strings.TrimSpace(testGit(t, bare, "rev-parse", "refs/heads/gitdm-sync/db")); sha != info.SHA {
+				t.Errorf("%s: bot branch is at %s, want %s", c.name, sha, info.SHA)
+			}
+		}
+		if (len(api.opened) == 1) != c.opened || len(api.opened) > 1 {
+			t.Errorf("%s: got %d opened PRs, want opened %v", c.name, len(api.opened), c.opened)
+		}
+		for _, pr := range api.opened {
+			if pr.Head != "gitdm-sync/db" || pr.Base != "master" || !strings.HasPrefix(pr.Title, "gitdm-sync: DB sync, ") ||
+				!strings.Contains(pr.Body, "`jdoe`") || !strings.Contains(pr.Body, info.SHA) {
+				t.Errorf("%s: got opened PR %+v", c.name, pr)
+			}
+		}
+		switch c.edited {
+		case "":
+			if len(api.edited) != 0 {
+				t.Errorf("%s: got PR updates %+v", c.name, api.edited)
+			}
+		case "closed":
+			if len(api.edited) != 1 || api.edited[0].State != "closed" {
+				t.Errorf("%s: got PR updates %+v, want PR closed", c.name, api.edited)
+			}
+		default:
+			if len(api.edited) != 1 || api.edited[0].State != "" || !strings.HasPrefix(api.edited[0].Title, "gitdm-sync: DB sync, ") {
+				t.Errorf("%s: got PR updates %+v, want title and body updated", c.name, api.edited)
+			}
+		}
+		if (len(api.merged) == 1) != c.merged || len(api.merged) > 1 {
+			t.Errorf("%s: got %d merges, want merged %v", c.name, len(api.merged), c.merged)
+		}
+		for _, merge := range api.merged {
+			if merge.SHA != info.SHA || merge.MergeMethod != "squash" || !strings.HasPrefix(merge.CommitTitle, "gitdm-bot gitdm-sync @ ") {
+				t.Errorf("%s: got merge %+v", c.name, merge)
+			}
+		}
+	}
+}
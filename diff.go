@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const maxDiffSectionItems = 100
+
+type profileChangeOutput struct {
+	Name    string   `yaml:"name"`
+	Changes []string `yaml:"changes"`
+}
+
+// profilesDiffOutput is a semantic difference between two profile lists: profiles are matched by identities
+// (or by name when identities changed), so a new enrollment shows as a changed profile, not as remove + add
+type profilesDiffOutput struct {
+	Added   []string               `yaml:"added,omitempty"`
+	Removed []string               `yaml:"removed,omitempty"`
+	Changed []*profileChangeOutput `yaml:"changed,omitempty"`
+}
+
+func (d *profilesDiffOutput) size() int {
+	return len(d.Added) + len(d.Removed) + len(d.Changed)
+}
+
+func (d *profilesDiffOutput) String() string {
+	return fmt.Sprintf("%d added, %d removed, %d changed", len(d.Added), len(d.Removed), len(d.Changed))
+}
+
+// identitiesKey identifies profile by its sorted identities
+func identitiesKey(prof *allOutput) string {
+	keys := []string{}
+	for _, identity := range prof.Identities {
+		keys = append(keys, identity.sortKey())
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\x00")
+}
+
+func optStr(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func enrollmentStr(rol *enrollmentShortOutput) string {
+	s := fmt.Sprintf("%s %s - %s (%s)", rol.Organization, rol.Start, rol.End, rol.Role)
+	if rol.ProjectSlug != nil {
+		s += " in " + *rol.ProjectSlug
+	}
+	return s
+}
+
+func identityStr(identity *identityShortOutput) string {
+	parts := []string{identity.Source}
+	for _, s := range []*string{identity.Name, identity.Email, identity.Username} {
+		if s != nil && *s != "" {
+			parts = append(parts, *s)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// profileChanges describes what changed between previous and current version of the same profile
+func profileChanges(prev, curr *allOutput) (changes []string) {
+	field := func(name, o, n string) {
+		if o != n {
+			changes = append(changes, fmt.Sprintf("%s: '%s' -> '%s'", name, o, n))
+		}
+	}
+	field("name", optStr(prev.Name), optStr(curr.Name))
+	field("email", optStr(prev.Email), optStr(curr.Email))
+	field("country", optStr(prev.CountryCode), optStr(curr.CountryCode))
+	field("gender", optStr(prev.Gender), optStr(curr.Gender))
+	prevBot, currBot := "", ""
+	if prev.IsBot != nil {
+		prevBot = fmt.Sprintf("%d", *prev.IsBot)
+	}
+	if curr.IsBot != nil {
+		currBot = fmt.Sprintf("%d", *curr.IsBot)
+	}
+	field("bot", prevBot, currBot)
+	listDiff := func(what string, o, n map[string]string) {
+		keys := []string{}
+		for key := range o {
+			if _, ok := n[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			changes = append(changes, "- "+what+" "+o[key])
+		}
+		keys = []string{}
+		for key := range n {
+			if _, ok := o[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			changes = append(changes, "+ "+what+" "+n[key])
+		}
+	}
+	rols := func(prof *allOutput) map[string]string {
+		m := make(map[string]string)
+		for _, rol := range prof.Enrollments {
+			m[rol.sortKey()] = enrollmentStr(rol)
+		}
+		return m
+	}
+	ids := func(prof *allOutput) map[string]string {
+		m := make(map[string]string)
+		for _, identity := range prof.Identities {
+			m[identity.sortKey()] = identityStr(identity)
+		}
+		return m
+	}
+	listDiff("enrollment", rols(prev), rols(curr))
+	listDiff("identity", ids(prev), ids(curr))
+	return
+}
+
+// diffProfiles returns semantic difference between old and new profiles
+func diffProfiles(oldProfs, newProfs []*allOutput) *profilesDiffOutput {
+	diff := &profilesDiffOutput{}
+	same := make(map[string]struct{})
+	for _, prof := range oldProfs {
+		same[prof.sortKey()] = struct{}{}
+	}
+	// unchanged profiles are skipped first, only the rest is matched
+	var oldLeft, newLeft []*allOutput
+	newKeys := make(map[string]struct{})
+	for _, prof := range newProfs {
+		key := prof.sortKey()
+		newKeys[key] = struct{}{}
+		if _, ok := same[key]; !ok {
+			newLeft = append(newLeft, prof)
+		}
+	}
+	for _, prof := range oldProfs {
+		if _, ok := newKeys[prof.sortKey()]; !ok {
+			oldLeft = append(oldLeft, prof)
+		}
+	}
+	matched := make(map[*allOutput]struct{})
+	changed := func(prev, curr *allOutput) {
+		matched[prev], matched[curr] = struct{}{}, struct{}{}
+		diff.Changed = append(diff.Changed, &profileChangeOutput{Name: curr.label(), Changes: profileChanges(prev, curr)})
+	}
+	for _, keyFn := range []func(*allOutput) string{identitiesKey, func(p *allOutput) string { return matchName(p.label()) }} {
+		byKey := make(map[string]*allOutput)
+		for _, prof := range oldLeft {
+			if _, ok := matched[prof]; !ok {
+				byKey[keyFn(prof)] = prof
+			}
+		}
+		for _, prof := range newLeft {
+			if _, ok := matched[prof]; ok {
+				continue
+			}
+			prev, ok := byKey[keyFn(prof)]
+			if ok {
+				if _, used := matched[prev]; !used {
+					changed(prev, prof)
+				}
+			}
+		}
+	}
+	for _, prof := range newLeft {
+		if _, ok := matched[prof]; !ok {
+			diff.Added = append(diff.Added, prof.label())
+		}
+	}
+	for _, prof := range oldLeft {
+		if _, ok := matched[prof]; !ok {
+			diff.Removed = append(diff.Removed, prof.label())
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.SliceStable(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].Name < diff.Changed[j].Name
+	})
+	return diff
+}
+
+// markdown returns diff as markdown, each section is limited to maxDiffSectionItems entries
+func (d *profilesDiffOutput) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s**\n", d.String())
+	section := func(title string, n int, item func(int) string) {
+		if n == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\n### %s (%d)\n\n", title, n)
+		for i := 0; i < n && i < maxDiffSectionItems; i++ {
+			b.WriteString(item(i))
+		}
+		if n > maxDiffSectionItems {
+			fmt.Fprintf(&b, "- ... and %d more\n", n-maxDiffSectionItems)
+		}
+	}
+	section("Added profiles", len(d.Added), func(i int) string { return "- " + d.Added[i] + "\n" })
+	section("Removed profiles", len(d.Removed), func(i int) string { return "- " + d.Removed[i] + "\n" })
+	section("Changed profiles", len(d.Changed), func(i int) string {
+		ch := d.Changed[i]
+		s := "- " + ch.Name + "\n"
+		for _, change := range ch.Changes {
+			s += "  - `" + change + "`\n"
+		}
+		return s
+	})
+	return b.String()
+}
@@ -15,4 +15,6 @@ AUTH0_URL=`cat secrets/AUTH0_URL.secret`
 AUTH0_AUDIENCE=`cat secrets/AUTH0_AUDIENCE.secret`
 AUTH0_CLIENT_ID=`cat secrets/AUTH0_CLIENT_ID.secret`
 AUTH0_CLIENT_SECRET=`cat secrets/AUTH0_CLIENT_SECRET.secret`
-docker run -p 17070:7070 -e "JWT_TOKEN=${JWT_TOKEN}" -e "AUTH0_URL=${AUTH0_URL}" -e "AUTH0_AUDIENCE=${AUTH0_AUDIENCE}" -e "AUTH0_CLIENT_ID=${AUTH0_CLIENT_ID}" -e "AUTH0_CLIENT_SECRET=${AUTH0_CLIENT_SECRET}" -e "DA_API_URL=${DA_API_URL}" -e "GITDM_GITHUB_REPO=${GITDM_GITHUB_REPO}" -e "GITDM_GITHUB_USER=${GITDM_GITHUB_USER}" -e "GITDM_GITHUB_OAUTH=${GITDM_GITHUB_OAUTH}" -e "GITDM_GIT_USER=${GITDM_GIT_USER}" -e "GITDM_GIT_EMAIL=${GITDM_GIT_EMAIL}" -it "${DOCKER_USER}/lf-gitdm-sync" "/bin/sh"
+GITDM_API_TOKEN=`cat secrets/GITDM_API_TOKEN.secret`
+GITDM_WEBHOOK_SECRET=`cat secrets/GITDM_WEBHOOK_SECRET.secret`
+docker run -p 17070:7070 -e "JWT_TOKEN=${JWT_TOKEN}" -e "AUTH0_URL=${AUTH0_URL}" -e "AUTH0_AUDIENCE=${AUTH0_AUDIENCE}" -e "AUTH0_CLIENT_ID=${AUTH0_CLIENT_ID}" -e "AUTH0_CLIENT_SECRET=${AUTH0_CLIENT_SECRET}" -e "DA_API_URL=${DA_API_URL}" -e "GITDM_GITHUB_REPO=${GITDM_GITHUB_REPO}" -e "GITDM_GITHUB_USER=${GITDM_GITHUB_USER}" -e "GITDM_GITHUB_OAUTH=${GITDM_GITHUB_OAUTH}" -e "GITDM_GIT_USER=${GITDM_GIT_USER}" -e "GITDM_GIT_EMAIL=${GITDM_GIT_EMAIL}" -e "GITDM_API_TOKEN=${GITDM_API_TOKEN}" -e "GITDM_WEBHOOK_SECRET=${GITDM_WEBHOOK_SECRET}" -it "${DOCKER_USER}/lf-gitdm-sync" "/bin/sh"
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	domainsFile   = "domains.yaml"
+	minEnrollDate = "1900-01-01"
+	maxEnrollDate = "2100-01-01"
+)
+
+type domainRuleOutput struct {
+	Domain       string  `yaml:"D"`
+	Organization string  `yaml:"C"`
+	Start        string  `yaml:"F,omitempty"`
+	End          string  `yaml:"T,omitempty"`
+	ProjectSlug  *string `yaml:"P,omitempty"`
+	Role         string  `yaml:"R,omitempty"`
+}
+
+type domainRulesOutput struct {
+	Rules    []*domainRuleOutput `yaml:"D,omitempty"`
+	Excluded []string            `yaml:"X,omitempty"`
+}
+
+type domainRules struct {
+	rules    map[string][]*domainRuleOutput
+	excluded map[string]struct{}
+}
+
+func (r *domainRuleOutput) start() string {
+	if r.Start == "" {
+		return minEnrollDate
+	}
+	return r.Start
+}
+
+func (r *domainRuleOutput) end() string {
+	if r.End == "" {
+		return maxEnrollDate
+	}
+	return r.End
+}
+
+func (r *domainRuleOutput) enrollment() *enrollmentShortOutput {
+	role := r.Role
+	if role == "" {
+		role = "C"
+	}
+	return &enrollmentShortOutput{
+		Start:        r.start(),
+		End:          r.end(),
+		Organization: r.Organization,
+		ProjectSlug:  r.ProjectSlug,
+		Role:         role,
+	}
+}
+
+// emailDomain returns lower case domain part of an email, emails can use '!' instead of '@'
+func emailDomain(email string) string {
+	i := strings.LastIndexAny(email, "!@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(email[i+1:]))
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Replace(email, "@", "!", -1)))
+}
+
+func validDate(dt string) bool {
+	_, err := time.Parse(dateFormat, dt)
+	return err == nil
+}
+
+func (d *domainRulesOutput) validate() (errs []string) {
+	for i, rule := range d.Rules {
+		if rule.Domain == "" || strings.ContainsAny(rule.Domain, "!@ ") {
+			errs = append(errs, fmt.Sprintf("domain rule #%d: invalid domain '%s'", i+1, rule.Domain))
+		}
+		if strings.TrimSpace(rule.Organization) == "" {
+			errs = append(errs, fmt.Sprintf("domain rule #%d (%s): organization is required", i+1, rule.Domain))
+		}
+		if rule.Start != "" && !validDate(rule.Start) {
+			errs = append(errs, fmt.Sprintf("domain rule #%d (%s): invalid date from '%s'", i+1, rule.Domain, rule.Start))
+		}
+		if rule.End != "" && !validDate(rule.End) {
+			errs = append(errs, fmt.Sprintf("domain rule #%d (%s): invalid date to '%s'", i+1, rule.Domain, rule.End))
+		}
+		if rule.start() >= rule.end() {
+			errs = append(errs, fmt.Sprintf("domain rule #%d (%s): date from '%s' must be before date to '%s'", i+1, rule.Domain, rule.start(), rule.end()))
+		}
+		if rule.Role != "" && rule.Role != "C" && rule.Role != "M" {
+			errs = append(errs, fmt.Sprintf("domain rule #%d (%s): invalid role '%s'", i+1, rule.Domain, rule.Role))
+		}
+	}
+	return
+}
+
+func (d *domainRulesOutput) rules() *domainRules {
+	r := &domainRules{rules: make(map[string][]*domainRuleOutput), excluded: make(map[string]struct{})}
+	for _, rule := range d.Rules {
+		domain := strings.ToLower(strings.TrimSpace(rule.Domain))
+		r.rules[domain] = append(r.rules[domain], rule)
+	}
+	for _, excluded := range d.Excluded {
+		r.excluded[normalizeEmail(excluded)] = struct{}{}
+	}
+	return r
+}
+
+// readDomainRules reads domain rules file, ok is false when it cannot be read, malformed file is returned
+// in parseErr, so it can be reported as a validation finding
+func readDomainRules(ctx context.Context) (rules *domainRulesOutput, ok bool, parseErr error) {
+	rules = &domainRulesOutput{}
+	data, err := ioutil.ReadFile(domainsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			mPrintf(ctx, "no %s file, domain rules are not used\n", domainsFile)
+			ok = true
+			return
+		}
+		fatalOnError(ctx, err, false)
+		return
+	}
+	mPrintf(ctx, "parse %s\n", domainsFile)
+	err = yaml.Unmarshal(data, rules)
+	if err != nil {
+		rules = &domainRulesOutput{}
+		parseErr = errors.Wrap(err, domainsFile)
+	}
+	ok = true
+	return
+}
+
+func getDomainRules(ctx context.Context) (*domainRules, bool) {
+	rules, ok, err := readDomainRules(ctx)
+	if !ok || fatalOnError(ctx, err, false) {
+		return nil, false
+	}
+	errs := rules.validate()
+	if len(errs) > 0 {
+		fatalf(ctx, false, "%s: %s", domainsFile, strings.Join(errs, "\n"))
+		return nil, false
+	}
+	orgs, ok := getOrganizations(ctx)
+	if !ok {
+		return nil, false
+	}
+	// explicit domain rules take precedence over organizations' domains
+	explicit := make(map[string]struct{})
+	for _, rule := range rules.Rules {
+		explicit[strings.ToLower(rule.Domain)] = struct{}{}
+	}
+	for _, rule := range orgs.domainRules() {
+		if _, ok := explicit[strings.ToLower(rule.Domain)]; !ok {
+			rules.Rules = append(rules.Rules, rule)
+		}
+	}
+	return rules.rules(), true
+}
+
+// match returns rules for the email's domain, a rule for "company.com" also matches "us.company.com",
+// the most specific domain wins, excluded domains and emails never match
+func (r *domainRules) match(email string) []*domainRuleOutput {
+	if r == nil || len(r.rules) == 0 {
+		return nil
+	}
+	domain := emailDomain(email)
+	if domain == "" {
+		return nil
+	}
+	if _, excluded := r.excluded[normalizeEmail(email)]; excluded {
+		return nil
+	}
+	for {
+		if _, excluded := r.excluded[domain]; excluded {
+			return nil
+		}
+		rules, ok := r.rules[domain]
+		if ok {
+			return rules
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return nil
+		}
+		domain = domain[i+1:]
+	}
+}
+
+func profileEmails(prof *allOutput) (emails []string) {
+	seen := make(map[string]struct{})
+	add := func(email *string) {
+		if email == nil || *email == "" {
+			return
+		}
+		e := normalizeEmail(*email)
+		if _, ok := seen[e]; ok {
+			return
+		}
+		seen[e] = struct{}{}
+		emails = append(emails, e)
+	}
+	add(prof.Email)
+	for _, identity := range prof.Identities {
+		add(identity.Email)
+	}
+	return
+}
+
+// domainEnrollments returns enrollments implied by domain rules for all profile's emails
+func (r *domainRules) domainEnrollments(prof *allOutput) (rols []*enrollmentShortOutput) {
+	seen := make(map[string]struct{})
+	for _, email := range profileEmails(prof) {
+		for _, rule := range r.match(email) {
+			rol := rule.enrollment()
+			key := rol.sortKey()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			rols = append(rols, rol)
+		}
+	}
+	sort.SliceStable(rols, func(i, j int) bool {
+		return rols[i].sortKey() < rols[j].sortKey()
+	})
+	return
+}
+
+// withDomainRules returns profiles where those without any enrollments get enrollments from domain rules,
+// original profiles are not modified, applied maps keys of changed profiles to the original profiles
+func withDomainRules(profs []*allOutput, r *domainRules) (res []*allOutput, applied map[string]*allOutput) {
+	applied = make(map[string]*allOutput)
+	if r == nil || len(r.rules) == 0 {
+		return profs, applied
+	}
+	res = make([]*allOutput, len(profs))
+	for i, prof := range profs {
+		res[i] = prof
+		if len(prof.Enrollments) > 0 {
+			continue
+		}
+		rols := r.domainEnrollments(prof)
+		if len(rols) == 0 {
+			continue
+		}
+		cp := *prof
+		cp.Enrollments = rols
+		cp.Identities = append([]*identityShortOutput(nil), prof.Identities...)
+		normalizeProfileOrder(&cp)
+		res[i] = &cp
+		applied[cp.sortKey()] = prof
+	}
+	return
+}
+
+// applyDomainRules returns profiles to be sent to DB: profiles without any enrollments get enrollments
+// from domain rules, original profiles are not modified
+func applyDomainRules(ctx context.Context, profs []*allOutput, r *domainRules) []*allOutput {
+	res, applied := withDomainRules(profs, r)
+	mPrintf(ctx, "domain rules applied to %d profiles\n", len(applied))
+	return res
+}
+
+// stripDomainRules returns DB profiles where enrollments added by applyDomainRules to profsYAML are removed again,
+// so DB sync never writes rule-derived enrollments to profile files; DB profiles whose enrollments were not derived
+// from profsYAML (including explicit enrollments equal to rules) are kept
+func stripDomainRules(ctx context.Context, profsDB, profsYAML []*allOutput, r *domainRules) []*allOutput {
+	_, applied := withDomainRules(profsYAML, r)
+	if len(applied) == 0 {
+		return profsDB
+	}
+	stripped := 0
+	res := make([]*allOutput, len(profsDB))
+	for i, prof := range profsDB {
+		if res[i] = stripDomainRule(prof, applied); res[i] != prof {
+			stripped++
+		}
+	}
+	mPrintf(ctx, "domain rules enrollments removed from %d DB profiles\n", stripped)
+	return res
+}
+
+// stripDomainRule returns the original profile when a DB profile is one of applied profiles returned by withDomainRules
+func stripDomainRule(prof *allOutput, applied map[string]*allOutput) *allOutput {
+	normalizeProfileOrder(prof)
+	if orig, ok := applied[prof.sortKey()]; ok {
+		return orig
+	}
+	return prof
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func testRules() *domainRules {
+	onap := "lfn/onap"
+	rules := &domainRulesOutput{
+		Rules: []*domainRuleOutput{
+			{Domain: "redhat.com", Organization: "Red Hat Inc."},
+			{Domain: "us.redhat.com", Organization: "Red Hat US"},
+			{Domain: "Company.com", Organization: "Company", Start: "2015-01-01", End: "2020-01-01"},
+			{Domain: "company.com", Organization: "Company ONAP", ProjectSlug: &onap, Role: "M"},
+		},
+		Excluded: []string{"gmail.com", "bot@redhat.com"},
+	}
+	return rules.rules()
+}
+
+func TestDomainRulesMatch(t *testing.T) {
+	rules := testRules()
+	var cases = []struct {
+		email string
+		orgs  []string
+	}{
+		{email: "jo@redhat.com", orgs: []string{"Red Hat Inc."}},
+		{email: "jo!redhat.com", orgs: []string{"Red Hat Inc."}},
+		{email: "Jo@RedHat.COM", orgs: []string{"Red Hat Inc."}},
+		{email: "jo@eu.redhat.com", orgs: []string{"Red Hat Inc."}},
+		{email: "jo@us.redhat.com", orgs: []string{"Red Hat US"}},
+		{email: "jo@dev.us.redhat.com", orgs: []string{"Red Hat US"}},
+		{email: "jo@company.com", orgs: []string{"Company", "Company ONAP"}},
+		{email: "bot@redhat.com"},
+		{email: "bot!redhat.com"},
+		{email: "jo@gmail.com"},
+		{email: "jo@notredhat.com"},
+		{email: "jo"},
+		{email: ""},
+	}
+	for _, c := range cases {
+		var orgs []string
+		for _, rule := range rules.match(c.email) {
+			orgs = append(orgs, rule.Organization)
+		}
+		if len(orgs) != len(c.orgs) {
+			t.Errorf("match(%q) = %v, want %v", c.email, orgs, c.orgs)
+			continue
+		}
+		for i := range orgs {
+			if orgs[i] != c.orgs[i] {
+				t.Errorf("match(%q) = %v, want %v", c.email, orgs, c.orgs)
+				break
+			}
+		}
+	}
+	var none *domainRules
+	if got := none.match("jo@redhat.com"); got != nil {
+		t.Errorf("match without rules = %v, want none", got)
+	}
+}
+
+func TestFindEnrollment(t *testing.T) {
+	rules := testRules()
+	onap, child := "lfn/onap", "lfn/onap/child"
+	projs := &projects{present: true, parents: map[string]string{child: onap, onap: "lfn"}}
+	email := "jo@company.com"
+	explicit := &allOutput{
+		Email: &email,
+		Enrollments: []*enrollmentShortOutput{
+			{Start: "2018-01-01", End: "2019-01-01", Organization: "Explicit", Role: "C"},
+		},
+	}
+	rhEmail := "jo@redhat.com"
+	identityOnly := &allOutput{Identities: []*identityShortOutput{{Email: &rhEmail}}}
+	var cases = []struct {
+		name    string
+		prof    *allOutput
+		emails  []string
+		dt      string
+		project string
+		org     string
+		source  string
+	}{
+		{name: "explicit enrollment wins", prof: explicit, dt: "2018-06-01", org: "Explicit", source: "enrollment"},
+		{name: "domain fallback outside explicit dates", prof: explicit, dt: "2016-06-01", org: "Company", source: "domain"},
+		{name: "domain rule dates", prof: explicit, dt: "2021-06-01", source: "none"},
+		{name: "project specific domain rule", prof: explicit, dt: "2021-06-01", project: onap, org: "Company ONAP", source: "domain"},
+		{name: "child project inherits domain rule", prof: explicit, dt: "2021-06-01", project: child, org: "Company ONAP", source: "domain"},
+		{name: "explicit global wins over project domain rule", prof: explicit, dt: "2018-06-01", project: onap, org: "Explicit", source: "enrollment"},
+		{name: "identity email", prof: identityOnly, dt: "2021-06-01", org: "Red Hat Inc.", source: "domain"},
+		{name: "no profile, queried email", emails: []string{normalizeEmail("x@us.redhat.com")}, dt: "2021-06-01", org: "Red Hat US", source: "domain"},
+		{name: "no profile, excluded email", emails: []string{normalizeEmail("x@gmail.com")}, dt: "2021-06-01", source: "none"},
+	}
+	for _, c := range cases {
+		rol, source := findEnrollment(c.prof, c.emails, c.dt, c.project, rules, projs)
+		org := ""
+		if rol != nil {
+			org = rol.Organization
+		}
+		if org != c.org || source != c.source {
+			t.Errorf("%s: got %q from %s, want %q from %s", c.name, org, source, c.org, c.source)
+		}
+	}
+}
+
+func TestDomainRulesDBRoundTrip(t *testing.T) {
+	rules := testRules()
+	ctx := context.Background()
+	noEnrollment := testProfile("Jo", "jo@us.redhat.com", "jo")
+	explicit := testProfile("Ann", "ann@redhat.com", "", testEnrollment("Explicit", "2010-01-01", "2100-01-01", nil))
+	// explicit enrollment equal to a rule's is not derived, it stays in profile files
+	sameAsRule := testProfile("Bo", "bo@redhat.com", "", testRules().rules["redhat.com"][0].enrollment())
+	excluded := testProfile("Gm", "gm@gmail.com", "")
+	profsYAML := []*allOutput{noEnrollment, explicit, sameAsRule, excluded}
+	api := newTestDAAPI(t, nil)
+	if !syncProfilesToDB(ctx, newCommitInfo("push", "test"), "abc", applyDomainRules(ctx, profsYAML, rules), nil) {
+		t.Fatal("sync failed")
+	}
+	if len(noEnrollment.Enrollments) != 0 {
+		t.Fatalf("profile file's profile was modified")
+	}
+	update := api.lastUpdate()
+	if update == nil || len(update.Add) != len(profsYAML) {
+		t.Fatalf("got update %+v", update)
+	}
+	for _, prof := range update.Add {
+		var orgs []string
+		for _, rol := range prof.Enrollments {
+			orgs = append(orgs, rol.Organization)
+		}
+		want := map[string]string{"Jo": "Red Hat US", "Ann": "Explicit", "Bo": "Red Hat Inc.", "Gm": ""}[*prof.Name]
+		if strings.Join(orgs, ",") != want {
+			t.Errorf("%s: DB payload has enrollments %v, want %q", *prof.Name, orgs, want)
+		}
+	}
+	profsDB, ok := getProfilesFromDB(ctx)
+	if !ok {
+		t.Fatal("cannot read DB")
+	}
+	stripped := stripDomainRules(ctx, profsDB, profsYAML, rules)
+	if got, want := profileKeys(stripped), profileKeys(profsYAML); len(got) != len(want) {
+		t.Fatalf("got %d profiles after stripping, want %d", len(got), len(want))
+	} else {
+		for key := range want {
+			if _, ok := got[key]; !ok {
+				t.Errorf("profile %q is not restored from DB", key)
+			}
+		}
+	}
+	// a profile added to DB with the same enrollment, but not present in profile files, is kept
+	other := testProfile("Cy", "cy@redhat.com", "", testRules().rules["redhat.com"][0].enrollment())
+	if got := stripDomainRules(ctx, []*allOutput{other}, profsYAML, rules); len(got[0].Enrollments) != 1 {
+		t.Errorf("enrollment of DB only profile was removed")
+	}
+}
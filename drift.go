@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// driftOutput compares repo with DB: added profiles are only in repo (push sync would add them), removed are only
+// in DB (push sync would delete them), changed are in both with different content
+type driftOutput struct {
+	SHA       string              `yaml:"sha,omitempty"`
+	InSync    bool                `yaml:"in_sync"`
+	Unchanged int                 `yaml:"unchanged"`
+	Changes   *profilesDiffOutput `yaml:"changes"`
+	Since     string              `yaml:"since,omitempty"`
+}
+
+// compareRepoWithDB returns drift between profiles of the current directory and DB, nothing is modified;
+// repo side is what a push sync would send to DB (domain rules applied)
+func compareRepoWithDB(ctx context.Context) (*driftOutput, bool) {
+	sha, ok := headSHA(ctx)
+	if !ok {
+		return nil, false
+	}
+	if !jobPhase(ctx, phaseParse) {
+		return nil, false
+	}
+	profsYAML, ok := getProfilesFromYAMLs(ctx)
+	if !ok {
+		return nil, false
+	}
+	rules, ok := getDomainRules(ctx)
+	if !ok {
+		return nil, false
+	}
+	profsYAML = applyDomainRules(ctx, profsYAML, rules)
+	if !jobPhase(ctx, phaseAPI) {
+		return nil, false
+	}
+	profsDB, ok := getProfilesFromDB(ctx)
+	if !ok {
+		return nil, false
+	}
+	out := profilesDrift(sha, profsYAML, profsDB)
+	mPrintf(ctx, "drift between %s and DB: %s, %d unchanged\n", sha, out.Changes, out.Unchanged)
+	return out, true
+}
+
+// profilesDrift compares repo profiles of a given commit with DB profiles, profiles equal on both sides are unchanged
+func profilesDrift(sha string, profsYAML, profsDB []*allOutput) *driftOutput {
+	inYAML, inDB := profileKeys(profsYAML), profileKeys(profsDB)
+	var onlyYAML, onlyDB []*allOutput
+	for _, prof := range profsYAML {
+		if _, ok := inDB[prof.sortKey()]; !ok {
+			onlyYAML = append(onlyYAML, prof)
+		}
+	}
+	for _, prof := range profsDB {
+		if _, ok := inYAML[prof.sortKey()]; !ok {
+			onlyDB = append(onlyDB, prof)
+		}
+	}
+	out := &driftOutput{SHA: sha, Unchanged: len(profsYAML) - len(onlyYAML), Changes: diffProfiles(onlyDB, onlyYAML)}
+	out.InSync = out.Changes.size() == 0
+	return out
+}
+
+// recordDrift saves when drift was first seen and updates drift metrics
+func recordDrift(ctx context.Context, out *driftOutput) bool {
+	now := time.Now()
+	ok := updateSyncState(ctx, func(st *syncStateOutput) {
+		if out.InSync {
+			st.DriftSince = ""
+		} else if st.DriftSince == "" {
+			st.DriftSince = now.Format(dateTimeFormat)
+		}
+		out.Since = st.DriftSince
+	})
+	if !ok {
+		return false
+	}
+	gMetrics.driftProfiles.WithLabelValues("added").Set(float64(len(out.Changes.Added)))
+	gMetrics.driftProfiles.WithLabelValues("removed").Set(float64(len(out.Changes.Removed)))
+	gMetrics.driftProfiles.WithLabelValues("changed").Set(float64(len(out.Changes.Changed)))
+	duration := 0.0
+	if since, err := time.ParseInLocation(dateTimeFormat, out.Since, time.Local); err == nil {
+		duration = now.Sub(since).Seconds()
+	}
+	gMetrics.driftDuration.Set(duration)
+	gMetrics.driftChecked.Set(float64(now.Unix()))
+	if !out.InSync {
+		mWarnf(ctx, "repo and DB differ since %s\n", out.Since)
+	}
+	return true
+}
+
+// checkDrift compares main branch with DB, w is nil for scheduled checks
+func checkDrift(parent context.Context, w http.ResponseWriter, id, caller string) (*driftOutput, bool) {
+	j, ok := startJob(parent, w, id, "drift")
+	defer endJob(j)
+	ctx := j.ctx
+	if !ok {
+		return nil, false
+	}
+	j.setCaller(caller)
+	var out *driftOutput
+	ok = inClonedRepo(ctx, "", func() bool {
+		out, ok = compareRepoWithDB(ctx)
+		return ok
+	})
+	if !ok || !recordDrift(ctx, out) {
+		return nil, false
+	}
+	return out, true
+}
+
+// handleDrift: GET /drift - compares main branch with DB without changing either of them
+func handleDrift(w http.ResponseWriter, req *http.Request) {
+	info := requestInfo(req)
+	reqPrintf(req, "Request: %s\n", info)
+	caller := req.URL.Query().Get("caller")
+	if caller == "" {
+		caller = "api"
+	}
+	out, ok := checkDrift(req.Context(), w, requestID(req), caller)
+	if !ok {
+		return
+	}
+	// job already ended, so the error is returned here
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		reqPrintf(req, "cannot marshal drift: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, timeStampStr()+err.Error()+"\n")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// scheduleDriftChecks runs drift check every drift_check_interval until the service is stopping,
+// so drift metrics stay current without an external caller
+func scheduleDriftChecks() {
+	ticker := time.NewTicker(gCfg.DriftCheckInterval)
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			if shuttingDown() {
+				return
+			}
+			_, _ = checkDrift(context.Background(), nil, "", "scheduler")
+		}
+	}()
+}
+
+// driftCommand: gitdm-sync drift - compares profiles in the current directory with DB, nothing is modified
+func driftCommand(ctx context.Context, args []string) bool {
+	if len(args) > 0 {
+		fatalf(ctx, false, "usage: drift")
+		return false
+	}
+	out, ok := compareRepoWithDB(ctx)
+	if !ok {
+		return false
+	}
+	data, err := yaml.Marshal(out)
+	if fatalOnError(ctx, err, false) {
+		return false
+	}
+	fmt.Printf("%s", data)
+	return out.InSync
+}
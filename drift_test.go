@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProfilesDrift(t *testing.T) {
+	acme, other := testEnrollment("Acme", "1900-01-01", "2100-01-01", nil), testEnrollment("Other", "1900-01-01", "2100-01-01", nil)
+	john := func(rols ...*enrollmentShortOutput) *allOutput {
+		return testProfile("John Doe", "john@example.com", "jdoe", rols...)
+	}
+	jane := func() *allOutput { return testProfile("Jane Roe", "jane@example.com", "jroe") }
+	bob := func() *allOutput { return testProfile("Bob", "bob@example.com", "bob") }
+	var cases = []struct {
+		name      string
+		yaml, db  []*allOutput
+		added     int
+		removed   int
+		changed   int
+		unchanged int
+	}{
+		{name: "empty"},
+		{name: "in sync", yaml: []*allOutput{john(acme), jane()}, db: []*allOutput{jane(), john(acme)}, unchanged: 2},
+		{name: "only in repo", yaml: []*allOutput{john(acme), jane()}, db: []*allOutput{john(acme)}, added: 1, unchanged: 1},
+		{name: "only in DB", yaml: []*allOutput{john(acme)}, db: []*allOutput{john(acme), jane()}, removed: 1, unchanged: 1},
+		{name: "changed", yaml: []*allOutput{john(other), jane()}, db: []*allOutput{john(acme), jane()}, changed: 1, unchanged: 1},
+		{
+			name: "all kinds", yaml: []*allOutput{john(other, acme), bob()}, db: []*allOutput{john(acme), jane()},
+			added: 1, removed: 1, changed: 1,
+		},
+		{name: "empty DB", yaml: []*allOutput{john(acme), jane()}, added: 2},
+	}
+	for _, c := range cases {
+		out := profilesDrift("abc", c.yaml, c.db)
+		if out.SHA != "abc" || len(out.Changes.Added) != c.added || len(out.Changes.Removed) != c.removed ||
+			len(out.Changes.Changed) != c.changed || out.Unchanged != c.unchanged {
+			t.Errorf("%s: got %s, %d unchanged", c.name, out.Changes, out.Unchanged)
+		}
+		if inSync := c.added+c.removed+c.changed == 0; out.InSync != inSync {
+			t.Errorf("%s: got in sync %v, want %v", c.name, out.InSync, inSync)
+		}
+	}
+	out := profilesDrift("abc", []*allOutput{john(acme), bob()}, []*allOutput{john(acme), jane()})
+	if out.Changes.Added[0] != bob().label() || out.Changes.Removed[0] != jane().label() {
+		t.Errorf("got %+v", out.Changes)
+	}
+}
+
+func TestRecordDrift(t *testing.T) {
+	saved := gCfg
+	defer func() { gCfg = saved }()
+	cfg := *saved
+	cfg.DataDir, cfg.LogLevel = t.TempDir(), levelWarn
+	gCfg = &cfg
+	ctx := context.Background()
+	drift := func() *driftOutput {
+		return profilesDrift("abc", []*allOutput{testProfile("A", "a@a.com", "")}, nil)
+	}
+	inSync := func() *driftOutput {
+		return profilesDrift("abc", []*allOutput{testProfile("A", "a@a.com", "")}, []*allOutput{testProfile("A", "a@a.com", "")})
+	}
+	driftSince := func() string {
+		st, ok := readSyncState(ctx)
+		if !ok {
+			t.Fatal("cannot read sync state")
+		}
+		return st.DriftSince
+	}
+	out := inSync()
+	if !recordDrift(ctx, out) || out.Since != "" || driftSince() != "" {
+		t.Fatalf("in sync: got since %q, state %q", out.Since, driftSince())
+	}
+	before := time.Now().Add(-time.Second).Format(dateTimeFormat)
+	out = drift()
+	if !recordDrift(ctx, out) || out.Since < before || out.Since != driftSince() {
+		t.Fatalf("first drift: got since %q, state %q", out.Since, driftSince())
+	}
+	// drift found earlier is kept while repo and DB still differ
+	first := "2024-01-02 03:04:05"
+	if !updateSyncState(ctx, func(st *syncStateOutput) { st.DriftSince = first }) {
+		t.Fatal("cannot update sync state")
+	}
+	out = drift()
+	if !recordDrift(ctx, out) || out.Since != first || driftSince() != first {
+		t.Errorf("continued drift: got since %q, state %q, want %s", out.Since, driftSince(), first)
+	}
+	out = inSync()
+	if !recordDrift(ctx, out) || out.Since != "" || driftSince() != "" {
+		t.Errorf("back in sync: got since %q, state %q", out.Since, driftSince())
+	}
+	out = drift()
+	if !recordDrift(ctx, out) || out.Since == "" || out.Since == first {
+		t.Errorf("new drift: got since %q", out.Since)
+	}
+}
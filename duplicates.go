@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	defaultDuplicateScore = 0.5
+	maxDuplicateBucket    = 20
+)
+
+type mergeCandidateOutput struct {
+	ID   string `yaml:"id"`
+	Name string `yaml:"name"`
+	File string `yaml:"file,omitempty"`
+	Line int    `yaml:"line,omitempty"`
+}
+
+type mergeProposalOutput struct {
+	Score    float64                 `yaml:"score"`
+	Reasons  []string                `yaml:"reasons"`
+	Profiles []*mergeCandidateOutput `yaml:"profiles"`
+}
+
+// profileID returns short hash identifying profile in a given state of data, changes when profile changes
+func (a *allOutput) profileID() string {
+	h := sha1.Sum([]byte(a.sortKey()))
+	return hex.EncodeToString(h[:])[:12]
+}
+
+// matchName returns name form used to compare names: normalized, transliterated, no punctuation, single spaces
+func matchName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, normalizeName(name, gCfg.Transliterate))
+	return strings.Join(strings.Fields(name), " ")
+}
+
+func profileNames(prof *allOutput) (names []string) {
+	seen := make(map[string]struct{})
+	add := func(name *string) {
+		if name == nil {
+			return
+		}
+		n := matchName(*name)
+		if n == "" {
+			return
+		}
+		if _, ok := seen[n]; ok {
+			return
+		}
+		seen[n] = struct{}{}
+		names = append(names, n)
+	}
+	add(prof.Name)
+	for _, identity := range prof.Identities {
+		add(identity.Name)
+	}
+	return
+}
+
+func profileUsernames(prof *allOutput) (usernames []string) {
+	seen := make(map[string]struct{})
+	for _, identity := range prof.Identities {
+		if identity.Username == nil || *identity.Username == "" {
+			continue
+		}
+		u := strings.ToLower(*identity.Username)
+		if _, ok := seen[u]; ok {
+			continue
+		}
+		seen[u] = struct{}{}
+		usernames = append(usernames, u)
+	}
+	return
+}
+
+func intersect(a, b []string) (common []string) {
+	m := make(map[string]struct{})
+	for _, s := range a {
+		m[s] = struct{}{}
+	}
+	for _, s := range b {
+		if _, ok := m[s]; ok {
+			common = append(common, s)
+		}
+	}
+	return
+}
+
+func overlaps(a, b *enrollmentShortOutput) bool {
+	return a.Start < b.End && b.Start < a.End
+}
+
+// sameScope returns true when both enrollments are global or both are for the same project
+func sameScope(a, b *enrollmentShortOutput) bool {
+	if a.ProjectSlug == nil || b.ProjectSlug == nil {
+		return a.ProjectSlug == nil && b.ProjectSlug == nil
+	}
+	return *a.ProjectSlug == *b.ProjectSlug
+}
+
+// conflicting returns true when enrollments overlap in the same scope with different organizations
+func conflicting(a, b *enrollmentShortOutput) bool {
+	return overlaps(a, b) && sameScope(a, b) && a.Organization != b.Organization
+}
+
+func (e *enrollmentShortOutput) label() string {
+	s := fmt.Sprintf("'%s' %s - %s", e.Organization, e.Start, e.End)
+	if e.ProjectSlug != nil {
+		s += " (" + *e.ProjectSlug + ")"
+	}
+	return s
+}
+
+// duplicateScore returns score in [0, 1] that two profiles describe the same person and reasons for it
+func duplicateScore(a, b *allOutput) (score float64, reasons []string) {
+	if emails := intersect(profileEmails(a), profileEmails(b)); len(emails) > 0 {
+		score += 0.5
+		reasons = append(reasons, "shared emails: "+strings.Join(emails, ", "))
+	}
+	if usernames := intersect(profileUsernames(a), profileUsernames(b)); len(usernames) > 0 {
+		score += 0.4
+		reasons = append(reasons, "shared usernames: "+strings.Join(usernames, ", "))
+	}
+	if names := intersect(profileNames(a), profileNames(b)); len(names) > 0 {
+		score += 0.3
+		reasons = append(reasons, "same names: "+strings.Join(names, ", "))
+	}
+	same, conflict := 0, 0
+	for _, ra := range a.Enrollments {
+		for _, rb := range b.Enrollments {
+			if !overlaps(ra, rb) || !sameScope(ra, rb) {
+				continue
+			}
+			if ra.Organization == rb.Organization {
+				same++
+			} else {
+				conflict++
+			}
+		}
+	}
+	if same > 0 {
+		score += 0.2
+		reasons = append(reasons, fmt.Sprintf("overlapping enrollments: %d", same))
+	} else if conflict > 0 {
+		score -= 0.2
+		reasons = append(reasons, fmt.Sprintf("conflicting enrollments: %d", conflict))
+	}
+	if score > 1.0 {
+		score = 1.0
+	}
+	if score < 0.0 {
+		score = 0.0
+	}
+	return
+}
+
+// findDuplicates returns merge proposals with score at least minScore, best first,
+// only profiles sharing a name, email or username are compared
+func findDuplicates(ctx context.Context, profs []*allOutput, locs []profileLocation, minScore float64) (proposals []*mergeProposalOutput) {
+	buckets := make(map[string][]int)
+	for i, prof := range profs {
+		for _, email := range profileEmails(prof) {
+			buckets["e:"+email] = append(buckets["e:"+email], i)
+		}
+		for _, username := range profileUsernames(prof) {
+			buckets["u:"+username] = append(buckets["u:"+username], i)
+		}
+		for _, name := range profileNames(prof) {
+			buckets["n:"+name] = append(buckets["n:"+name], i)
+		}
+	}
+	pairs := make(map[[2]int]struct{})
+	for key, idxs := range buckets {
+		if len(idxs) < 2 {
+			continue
+		}
+		if len(idxs) > maxDuplicateBucket {
+			mPrintf(ctx, "skipping %d profiles sharing too common key '%s'\n", len(idxs), key)
+			continue
+		}
+		for i := 0; i < len(idxs); i++ {
+			for j := i + 1; j < len(idxs); j++ {
+				if idxs[i] != idxs[j] {
+					pairs[[2]int{idxs[i], idxs[j]}] = struct{}{}
+				}
+			}
+		}
+	}
+	mPrintf(ctx, "scoring %d candidate pairs\n", len(pairs))
+	candidate := func(i int) *mergeCandidateOutput {
+		c := &mergeCandidateOutput{ID: profs[i].profileID(), Name: profs[i].label()}
+		if locs != nil {
+			c.File, c.Line = locs[i].File, locs[i].Line
+		}
+		return c
+	}
+	for pair := range pairs {
+		score, reasons := duplicateScore(profs[pair[0]], profs[pair[1]])
+		if score < minScore {
+			continue
+		}
+		proposals = append(
+			proposals,
+			&mergeProposalOutput{
+				Score:    float64(int(score*100+0.5)) / 100.0,
+				Reasons:  reasons,
+				Profiles: []*mergeCandidateOutput{candidate(pair[0]), candidate(pair[1])},
+			},
+		)
+	}
+	sort.Slice(proposals, func(i, j int) bool {
+		if proposals[i].Score == proposals[j].Score {
+			return proposals[i].Profiles[0].ID+proposals[i].Profiles[1].ID < proposals[j].Profiles[0].ID+proposals[j].Profiles[1].ID
+		}
+		return proposals[i].Score > proposals[j].Score
+	})
+	return
+}
+
+// mergeProfiles merges identities and enrollments of all other profiles into the first one,
+// profile level fields are taken from the first profile having them set; enrollments of different profiles
+// which overlap in the same scope with different organizations are returned as conflicts
+func mergeProfiles(profs []*allOutput) (*allOutput, []string) {
+	merged := *profs[0]
+	ids := make(map[string]struct{})
+	rols := make(map[string]struct{})
+	merged.Identities = nil
+	merged.Enrollments = nil
+	var (
+		from      []int
+		conflicts []string
+	)
+	for p, prof := range profs {
+		if merged.Name == nil {
+			merged.Name = prof.Name
+		}
+		if merged.Email == nil {
+			merged.Email = prof.Email
+		}
+		if merged.CountryCode == nil {
+			merged.CountryCode = prof.CountryCode
+		}
+		if merged.Gender == nil {
+			merged.Gender = prof.Gender
+		}
+		if merged.IsBot == nil {
+			merged.IsBot = prof.IsBot
+		}
+		for _, identity := range prof.Identities {
+			key := identity.sortKey()
+			if _, ok := ids[key]; ok {
+				continue
+			}
+			ids[key] = struct{}{}
+			merged.Identities = append(merged.Identities, identity)
+		}
+		for _, rol := range prof.Enrollments {
+			key := rol.sortKey()
+			if _, ok := rols[key]; ok {
+				continue
+			}
+			rols[key] = struct{}{}
+			for i, other := range merged.Enrollments {
+				if from[i] != p && conflicting(rol, other) {
+					conflicts = append(conflicts, fmt.Sprintf("%s of '%s' conflicts with %s of '%s'", rol.label(), prof.label(), other.label(), profs[from[i]].label()))
+				}
+			}
+			merged.Enrollments = append(merged.Enrollments, rol)
+			from = append(from, p)
+		}
+	}
+	return &merged, conflicts
+}
+
+// duplicatesCommand: gitdm-sync duplicates [min_score] - outputs ranked merge proposals
+func duplicatesCommand(ctx context.Context, args []string) bool {
+	minScore := defaultDuplicateScore
+	if len(args) > 0 {
+		var err error
+		minScore, err = strconv.ParseFloat(args[0], 64)
+		if fatalOnError(ctx, err, false) {
+			return false
+		}
+	}
+	profs, locs, err := getProfilesWithLocations(ctx)
+	if fatalOnError(ctx, err, false) {
+		return false
+	}
+	proposals := findDuplicates(ctx, profs, locs, minScore)
+	mPrintf(ctx, "found %d merge proposals with score >= %.2f\n", len(proposals), minScore)
+	data, err := yaml.Marshal(proposals)
+	if fatalOnError(ctx, err, false) {
+		return false
+	}
+	fmt.Printf("%s", data)
+	return true
+}
+
+// mergeCommand: gitdm-sync merge id1 id2 [id3 ...] - merges profiles with given ids into the first one
+func mergeCommand(ctx context.Context, args []string) bool {
+	if len(args) < 2 {
+		fatalf(ctx, false, "usage: merge id1 id2 [id3 ...]")
+		return false
+	}
+	profs, ok := getProfilesFromYAMLs(ctx)
+	if !ok {
+		return false
+	}
+	byID := make(map[string]int)
+	for i, prof := range profs {
+		byID[prof.profileID()] = i
+	}
+	var (
+		toMerge []*allOutput
+		idxs    = make(map[int]struct{})
+	)
+	for _, id := range args {
+		i, ok := byID[id]
+		if !ok {
+			fatalf(ctx, false, "profile '%s' not found, profile ids change when profiles change, regenerate them using 'duplicates'", id)
+			return false
+		}
+		if _, dup := idxs[i]; dup {
+			continue
+		}
+		idxs[i] = struct{}{}
+		toMerge = append(toMerge, profs[i])
+	}
+	merged, conflicts := mergeProfiles(toMerge)
+	if len(conflicts) > 0 {
+		fatalf(ctx, false, "cannot merge, %d conflicting enrollment(s), fix them first:\n%s", len(conflicts), strings.Join(conflicts, "\n"))
+		return false
+	}
+	findings, ok := validateRegistries(ctx, []*allOutput{merged}, []profileLocation{{File: "merged profile"}})
+	if !ok {
+		return false
+	}
+	if len(findings) > 0 {
+		fatalf(ctx, false, "cannot merge, %d validation error(s):\n%s", len(findings), findingsText(findings))
+		return false
+	}
+	var res []*allOutput
+	for i, prof := range profs {
+		if _, ok := idxs[i]; ok {
+			continue
+		}
+		res = append(res, prof)
+	}
+	res = append(res, merged)
+	mPrintf(ctx, "merged %d profiles into '%s' (%d identities, %d enrollments)\n", len(toMerge), merged.label(), len(merged.Identities), len(merged.Enrollments))
+	removeCurrentYAMLs(ctx)
+	if !writeProfiles(ctx, res) {
+		return false
+	}
+	mPrintf(ctx, "merged profile id: %s\n", merged.profileID())
+	return true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func sp(s string) *string {
+	return &s
+}
+
+func testProfile(name, email, username string, rols ...*enrollmentShortOutput) *allOutput {
+	prof := &allOutput{Enrollments: rols}
+	if name != "" {
+		prof.Name = sp(name)
+	}
+	if email != "" {
+		prof.Email = sp(email)
+	}
+	if username != "" {
+		prof.Identities = append(prof.Identities, &identityShortOutput{Source: "github", Username: sp(username)})
+	}
+	return prof
+}
+
+func testEnrollment(org, start, end string, project *string) *enrollmentShortOutput {
+	return &enrollmentShortOutput{Organization: org, Start: start, End: end, ProjectSlug: project, Role: "C"}
+}
+
+func TestDuplicateScore(t *testing.T) {
+	acme := testEnrollment("Acme", "2010-01-01", "2020-01-01", nil)
+	acmeLater := testEnrollment("Acme", "2015-01-01", "2100-01-01", nil)
+	other := testEnrollment("Other", "2015-01-01", "2100-01-01", nil)
+	otherProject := testEnrollment("Other", "2015-01-01", "2100-01-01", sp("lfn/onap"))
+	var cases = []struct {
+		name    string
+		a, b    *allOutput
+		score   float64
+		reasons int
+	}{
+		{name: "nothing shared", a: testProfile("Jo Doe", "jo@a.com", "jo"), b: testProfile("Bob", "bob@b.com", "bob"), score: 0.0},
+		{name: "email", a: testProfile("", "Jo@A.com", ""), b: testProfile("", "jo!a.com", ""), score: 0.5, reasons: 1},
+		{name: "email and username", a: testProfile("", "jo@a.com", "Jo"), b: testProfile("", "jo@a.com", "jo"), score: 0.9, reasons: 2},
+		{name: "name", a: testProfile("Jo Doe", "", ""), b: testProfile("jo  doe", "", ""), score: 0.3, reasons: 1},
+		{name: "name and same enrollment", a: testProfile("Jo Doe", "", "", acme), b: testProfile("Jo Doe", "", "", acmeLater), score: 0.5, reasons: 2},
+		{name: "name and conflicting enrollment", a: testProfile("Jo Doe", "", "", acme), b: testProfile("Jo Doe", "", "", other), score: 0.1, reasons: 2},
+		{name: "different scopes don't conflict", a: testProfile("Jo Doe", "", "", acme), b: testProfile("Jo Doe", "", "", otherProject), score: 0.3, reasons: 1},
+		{name: "only conflicting enrollment", a: testProfile("", "", "", acme), b: testProfile("", "", "", other), score: 0.0, reasons: 1},
+		{name: "capped", a: testProfile("Jo Doe", "jo@a.com", "jo", acme), b: testProfile("Jo Doe", "jo@a.com", "jo", acme), score: 1.0, reasons: 4},
+	}
+	for _, c := range cases {
+		score, reasons := duplicateScore(c.a, c.b)
+		if int(score*100+0.5) != int(c.score*100+0.5) || len(reasons) != c.reasons {
+			t.Errorf("%s: got %.2f %v, want %.2f with %d reason(s)", c.name, score, reasons, c.score, c.reasons)
+		}
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	profs := []*allOutput{
+		testProfile("Jo Doe", "jo@a.com", "jo"),
+		testProfile("Bob", "bob@b.com", "bob"),
+		testProfile("Jo Doe", "jo@a.com", ""),
+		testProfile("Jo Doe", "jo@c.com", ""),
+	}
+	locs := []profileLocation{{File: "p1.yaml", Line: 1}, {File: "p1.yaml", Line: 9}, {File: "p2.yaml", Line: 1}, {File: "p2.yaml", Line: 5}}
+	var cases = []struct {
+		minScore float64
+		pairs    []string
+	}{
+		{minScore: 0.5, pairs: []string{"p1.yaml:1 p2.yaml:1"}},
+		{minScore: 0.3, pairs: []string{"p1.yaml:1 p2.yaml:1", "p1.yaml:1 p2.yaml:5", "p2.yaml:1 p2.yaml:5"}},
+		{minScore: 0.9},
+	}
+	for _, c := range cases {
+		proposals := findDuplicates(context.Background(), profs, locs, c.minScore)
+		var pairs []string
+		for _, p := range proposals {
+			if len(p.Profiles) != 2 {
+				t.Fatalf("proposal %+v has %d profiles", p, len(p.Profiles))
+			}
+			a, b := p.Profiles[0], p.Profiles[1]
+			pairs = append(pairs, a.File+":"+strconv.Itoa(a.Line)+" "+b.File+":"+strconv.Itoa(b.Line))
+		}
+		// proposals with equal scores are ordered by profile ids, which are hashes
+		if len(pairs) > 1 {
+			sort.Strings(pairs[1:])
+		}
+		if strings.Join(pairs, ", ") != strings.Join(c.pairs, ", ") {
+			t.Errorf("min score %.1f: got %v, want %v", c.minScore, pairs, c.pairs)
+		}
+	}
+}
+
+func TestMergeProfiles(t *testing.T) {
+	acme := testEnrollment("Acme", "2010-01-01", "2020-01-01", nil)
+	other := testEnrollment("Other", "2015-01-01", "2100-01-01", nil)
+	otherProject := testEnrollment("Other", "2015-01-01", "2100-01-01", sp("lfn/onap"))
+	later := testEnrollment("Later", "2020-01-01", "2100-01-01", nil)
+	var cases = []struct {
+		name      string
+		profs     []*allOutput
+		rols      int
+		ids       int
+		conflicts int
+	}{
+		{name: "duplicates removed", profs: []*allOutput{testProfile("Jo", "jo@a.com", "jo", acme), testProfile("", "", "jo", acme, later)}, rols: 2, ids: 1},
+		{name: "different scopes", profs: []*allOutput{testProfile("Jo", "", "jo", acme), testProfile("", "", "jo2", otherProject)}, rols: 2, ids: 2},
+		{name: "conflict", profs: []*allOutput{testProfile("Jo", "", "", acme), testProfile("", "", "", other)}, rols: 2, conflicts: 1},
+		{name: "conflict with each of 2 profiles", profs: []*allOutput{testProfile("Jo", "", "", acme), testProfile("", "", "", later), testProfile("", "", "", other)}, rols: 3, conflicts: 2},
+		{name: "conflict within one profile is kept", profs: []*allOutput{testProfile("Jo", "", "", acme, other), testProfile("", "", "", otherProject)}, rols: 3},
+	}
+	for _, c := range cases {
+		merged, conflicts := mergeProfiles(c.profs)
+		if len(merged.Enrollments) != c.rols || len(merged.Identities) != c.ids || len(conflicts) != c.conflicts {
+			t.Errorf("%s: got %d enrollments, %d identities, conflicts %v, want %d, %d, %d", c.name, len(merged.Enrollments), len(merged.Identities), conflicts, c.rols, c.ids, c.conflicts)
+		}
+	}
+	merged, _ := mergeProfiles([]*allOutput{testProfile("", "", "jo"), testProfile("Jo", "jo@a.com", ""), testProfile("Bob", "bob@b.com", "")})
+	if merged.Name == nil || *merged.Name != "Jo" || merged.Email == nil || *merged.Email != "jo@a.com" {
+		t.Errorf("profile fields should come from the first profile having them, got %s", merged.label())
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html"
@@ -10,57 +11,55 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
-	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
-	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	yaml "gopkg.in/yaml.v2"
 )
 
 const (
+	dateFormat           = "2006-01-02"
 	dateTimeFormat       = "2006-01-02 15:04:05"
 	dateTimeFormatMillis = "2006-01-02 15:04:05.999"
 )
 
 var (
-	gMtx   *sync.Mutex
-	gw     http.ResponseWriter
-	gToken string
+	gMtx        *sync.Mutex
+	gToken      string
+	gHTTPClient = http.DefaultClient
 )
 
 type enrollmentShortOutput struct {
-	End          string  `yaml:"T"`
-	Organization string  `yaml:"C"`
-	Start        string  `yaml:"F"`
-	ProjectSlug  *string `yaml:"P,omitempty"`
-	Role         string  `yaml:"R"`
+	End          string  `json:"T" yaml:"T"`
+	Organization string  `json:"C" yaml:"C"`
+	Start        string  `json:"F" yaml:"F"`
+	ProjectSlug  *string `json:"P,omitempty" yaml:"P,omitempty"`
+	Role         string  `json:"R" yaml:"R"`
 }
 
 type identityShortOutput struct {
-	Email    *string `yaml:"E,omitempty"`
-	Name     *string `yaml:"M,omitempty"`
-	Source   string  `yaml:"S"`
-	Username *string `yaml:"U,omitempty"`
+	Email    *string `json:"E,omitempty" yaml:"E,omitempty"`
+	Name     *string `json:"M,omitempty" yaml:"M,omitempty"`
+	Source   string  `json:"S" yaml:"S"`
+	Username *string `json:"U,omitempty" yaml:"U,omitempty"`
 }
 
 type allOutput struct {
-	CountryCode *string                  `yaml:"C,omitempty"`
-	Email       *string                  `yaml:"E,omitempty"`
-	Enrollments []*enrollmentShortOutput `yaml:"R,omitempty"`
-	Gender      *string                  `yaml:"S,omitempty"`
-	Identities  []*identityShortOutput   `yaml:"I,omitempty"`
-	IsBot       *int64                   `yaml:"B,omitempty"`
-	Name        *string                  `yaml:"U,omitempty"`
+	CountryCode *string                  `json:"C,omitempty" yaml:"C,omitempty"`
+	Email       *string                  `json:"E,omitempty" yaml:"E,omitempty"`
+	Enrollments []*enrollmentShortOutput `json:"R,omitempty" yaml:"R,omitempty"`
+	Gender      *string                  `json:"S,omitempty" yaml:"S,omitempty"`
+	Identities  []*identityShortOutput   `json:"I,omitempty" yaml:"I,omitempty"`
+	IsBot       *int64                   `json:"B,omitempty" yaml:"B,omitempty"`
+	Name        *string                  `json:"U,omitempty" yaml:"U,omitempty"`
 }
 
 type allArrayOutput struct {
-	Profiles []*allOutput `yaml:"P,omitempty"`
+	Profiles []*allOutput `json:"P,omitempty" yaml:"P,omitempty"`
 }
 
 type dbUpdate struct {
@@ -185,10 +184,25 @@ func (a *allOutput) sortKey() (key string) {
 	return
 }
 
-func mPrintf(format string, args ...interface{}) (n int, err error) {
-	now := time.Now()
-	n, err = fmt.Printf("%s", fmt.Sprintf("%s: "+format, append([]interface{}{now.Format(dateTimeFormatMillis)}, args...)...))
-	return
+func (a *allOutput) label() string {
+	if a.Name != nil && *a.Name != "" {
+		return *a.Name
+	}
+	if a.Email != nil && *a.Email != "" {
+		return *a.Email
+	}
+	for _, identity := range a.Identities {
+		if identity.Name != nil && *identity.Name != "" {
+			return *identity.Name
+		}
+		if identity.Email != nil && *identity.Email != "" {
+			return *identity.Email
+		}
+		if identity.Username != nil && *identity.Username != "" {
+			return *identity.Username
+		}
+	}
+	return "(unnamed)"
 }
 
 func timeStampStr() string {
@@ -200,14 +214,19 @@ func jsonEscape(str string) string {
 	return string(b[1 : len(b)-1])
 }
 
-func fatalOnError(err error, pnic bool) bool {
+// fatalOnError logs error, fails the job of ctx and returns the error to its client, stack trace is logged only
+// when it panics
+func fatalOnError(ctx context.Context, err error, pnic bool) bool {
 	if err != nil {
-		tm := time.Now()
-		mPrintf("Error(time=%+v):\nError: '%s'\nStacktrace:\n%s\n", tm, err.Error(), string(debug.Stack()))
-		fmt.Fprintf(os.Stderr, "Error(time=%+v):\nError: '%s'\nStacktrace:\n", tm, err.Error())
-		if gw != nil {
-			gw.WriteHeader(http.StatusBadRequest)
-			_, _ = io.WriteString(gw, timeStampStr()+err.Error()+"\n")
+		msg := redact(err.Error())
+		gStatus.recordError(ctxRequestID(ctx), msg)
+		if pnic {
+			logStack(ctx, msg)
+		} else {
+			logf(ctxFields(ctx), levelError, "%s", msg)
+		}
+		if j := ctxJob(ctx); j != nil {
+			j.failed(msg)
 		}
 		if pnic {
 			panic("stacktrace")
@@ -217,21 +236,26 @@ func fatalOnError(err error, pnic bool) bool {
 	return false
 }
 
-func fatalf(pnic bool, f string, a ...interface{}) {
-	fatalOnError(fmt.Errorf(f, a...), pnic)
+func fatalf(ctx context.Context, pnic bool, f string, a ...interface{}) {
+	fatalOnError(ctx, fmt.Errorf(f, a...), pnic)
 }
 
-func execCommand(cmdAndArgs []string, env map[string]string, dbg int, allowedExitCodes []int) (string, bool) {
+// execCommandErr runs a command and returns its stdout, failure is returned as an error containing stdout and stderr
+func execCommandErr(ctx context.Context, cmdAndArgs []string, env map[string]string, dbg int, allowedExitCodes []int) (string, error) {
 	if dbg > 0 {
 		if len(env) > 0 {
-			mPrintf("%+v %s\n", env, strings.Join(cmdAndArgs, " "))
+			mDebugf(ctx, "%+v %s\n", env, strings.Join(cmdAndArgs, " "))
 		} else {
-			mPrintf("%s\n", strings.Join(cmdAndArgs, " "))
+			mDebugf(ctx, "%s\n", strings.Join(cmdAndArgs, " "))
 		}
 	}
 	command := cmdAndArgs[0]
 	arguments := cmdAndArgs[1:]
-	cmd := exec.Command(command, arguments...)
+	// command is killed when current job phase times out or is cancelled, command_timeout caps a single command
+	jobCtx := jobContext(ctx)
+	ctx, cancel := context.WithTimeout(jobCtx, gCfg.CommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command, arguments...)
 	if len(env) > 0 {
 		newEnv := os.Environ()
 		for key, value := range env {
@@ -245,15 +269,16 @@ func execCommand(cmdAndArgs []string, env map[string]string, dbg int, allowedExi
 	)
 	cmd.Stderr = &stdErr
 	cmd.Stdout = &stdOut
-	if fatalOnError(cmd.Start(), false) {
-		return "cmd.Start() failed", false
+	err := cmd.Start()
+	if err != nil {
+		return "cmd.Start() failed", err
 	}
-	err := cmd.Wait()
+	err = cmd.Wait()
 	if err != nil {
 		for _, allowed := range allowedExitCodes {
 			if err.Error() == fmt.Sprintf("exit status %d", allowed) {
 				if dbg > 0 {
-					mPrintf("exit code %d but this is allowed\n", allowed)
+					mDebugf(ctx, "exit code %d but this is allowed\n", allowed)
 				}
 				err = nil
 				break
@@ -263,16 +288,27 @@ func execCommand(cmdAndArgs []string, env map[string]string, dbg int, allowedExi
 	if err != nil || dbg > 1 {
 		outStr := stdOut.String()
 		errStr := stdErr.String()
-		mPrintf("STDOUT:\n%v\n", outStr)
-		mPrintf("STDERR:\n%v\n", errStr)
+		mDebugf(ctx, "STDOUT:\n%v\n", outStr)
+		mDebugf(ctx, "STDERR:\n%v\n", errStr)
 		if err != nil {
 			err = fmt.Errorf("%+v\nstdout:\n%s\nstderr:\n%s", err, outStr, errStr)
-		}
-		if fatalOnError(err, false) {
-			return "cmd.Wait() failed", false
+			if jobCtx.Err() != nil {
+				err = jobError(ctx, err)
+			} else if ctx.Err() != nil {
+				err = fmt.Errorf("command '%s' timed out after %v: %v", command, gCfg.CommandTimeout, err)
+			}
+			return "cmd.Wait() failed", err
 		}
 	}
-	return stdOut.String(), true
+	return stdOut.String(), nil
+}
+
+func execCommand(ctx context.Context, cmdAndArgs []string, env map[string]string, dbg int, allowedExitCodes []int) (string, bool) {
+	out, err := execCommandErr(ctx, cmdAndArgs, env, dbg, allowedExitCodes)
+	if fatalOnError(ctx, err, false) {
+		return out, false
+	}
+	return out, true
 }
 
 func requestInfo(r *http.Request) string {
@@ -292,7 +328,8 @@ func requestInfo(r *http.Request) string {
 	return fmt.Sprintf("IP: %s, method: %s, path: %s", r.RemoteAddr, method, path)
 }
 
-func syncProfilesToDB(profsYAML, profsDB []*allOutput) bool {
+// syncProfilesToDB updates DB to match profiles from YAML files of a given commit, each update is recorded in audit log
+func syncProfilesToDB(ctx context.Context, info *commitInfo, sha string, profsYAML, profsDB []*allOutput) bool {
 	mYAML := make(map[string]*allOutput)
 	mDB := make(map[string]*allOutput)
 	for _, profYAML := range profsYAML {
@@ -306,177 +343,147 @@ func syncProfilesToDB(profsYAML, profsDB []*allOutput) bool {
 	for keyDB := range mDB {
 		_, ok := mYAML[keyDB]
 		if !ok {
-			mPrintf("DB key '%s' missing in YAML\n", keyDB)
+			mPrintf(ctx, "DB key '%s' missing in YAML\n", keyDB)
 			delDB = append(delDB, mDB[keyDB])
 		}
 	}
 	for keyYAML := range mYAML {
 		_, ok := mDB[keyYAML]
 		if !ok {
-			mPrintf("YAML key '%s' missing in DB\n", keyYAML)
+			mPrintf(ctx, "YAML key '%s' missing in DB\n", keyYAML)
 			addDB = append(addDB, mYAML[keyYAML])
 		}
 	}
+	gMetrics.dbChanges.WithLabelValues("add").Observe(float64(len(addDB)))
+	gMetrics.dbChanges.WithLabelValues("delete").Observe(float64(len(delDB)))
 	if len(addDB) == 0 && len(delDB) == 0 {
-		mPrintf("No DB changes needed\n")
+		mPrintf(ctx, "No DB changes needed\n")
 		return true
 	}
-	if !updateDB(addDB, delDB) {
-		return false
+	_, ok := applyDBUpdate(ctx, info, sha, profsDB, addDB, delDB)
+	return ok
+}
+
+// applyDBUpdate saves snapshot of DB state, updates DB and records the update in audit log, all under the same sync ID
+func applyDBUpdate(ctx context.Context, info *commitInfo, sha string, profsDB, addDB, delDB []*allOutput) (string, bool) {
+	id := ctxRequestID(ctx)
+	if id == "" {
+		id = newJobID()
 	}
-	return true
+	if !saveSnapshot(ctx, id, profsDB) {
+		return "", false
+	}
+	text, ok := updateDB(ctx, addDB, delDB)
+	if !ok {
+		return "", false
+	}
+	return id, recordAudit(ctx, id, info, sha, text, addDB, delDB)
 }
 
-func checkProfiles(profs []*allOutput, checkLastCommit bool) (bool, bool) {
+// writeProfiles sorts profiles and writes them to profile files, at most sort_run_size profiles are sorted in memory
+func writeProfiles(ctx context.Context, profs []*allOutput) bool {
 	//rand.Seed(time.Now().UnixNano())
 	//rand.Shuffle(len(profs), func(i, j int) { profs[i], profs[j] = profs[j], profs[i] })
-	mPrintf("sorting\n")
-	for k := range profs {
-		if len(profs[k].Enrollments) > 1 {
-			sort.SliceStable(profs[k].Enrollments, func(i, j int) bool {
-				rols := profs[k].Enrollments
-				return rols[i].sortKey() < rols[j].sortKey()
-			})
-		}
-		if len(profs[k].Identities) > 1 {
-			sort.SliceStable(profs[k].Identities, func(i, j int) bool {
-				ids := profs[k].Identities
-				return ids[i].sortKey() < ids[j].sortKey()
-			})
-		}
-	}
-	sort.SliceStable(profs, func(i, j int) bool {
-		return profs[i].sortKey() < profs[j].sortKey()
-	})
-	currSize := 0
-	profSize := 0
-	from := 0
-	maxSize := (1 << 20) - 8
-	ranges := [][2]int{}
-	mPrintf("fitting %d profs in files no larger than %d bytes\n", len(profs), maxSize)
-	for i, prof := range profs {
-		profSize = prof.size()
-		if currSize+profSize > maxSize {
-			ranges = append(ranges, [2]int{from, i})
-			from = i
-			currSize = 0
-		} else {
-			currSize += profSize
+	mPrintf(ctx, "sorting\n")
+	sorter := newProfileSorter(ctx, gCfg.SortRunSize)
+	defer sorter.close()
+	for _, prof := range profs {
+		if fatalOnError(ctx, sorter.add(prof), false) {
+			return false
 		}
 	}
-	if from != len(profs)-1 {
-		ranges = append(ranges, [2]int{from, len(profs)})
+	return writeSortedProfiles(ctx, sorter)
+}
+
+// writeSortedProfiles writes profiles merged by sorter to profile files, files are encoded concurrently
+func writeSortedProfiles(ctx context.Context, sorter *profileSorter) bool {
+	if !jobPhase(ctx, phaseWrite) {
+		return false
+	}
+	w := newShardWriter(ctx)
+	err := sorter.merge(w.write)
+	if e := w.close(); err == nil {
+		err = e
 	}
-	mPrintf("data ranges: %+v\n", ranges)
-	for i, rng := range ranges {
-		var all allArrayOutput
-		all.Profiles = profs[rng[0]:rng[1]]
-		mPrintf("writting profiles%d.yaml [%d-%d]\n", i+1, rng[0], rng[1])
-		data, err := yaml.Marshal(&all)
-		if fatalOnError(err, false) {
-			return false, false
+	return !fatalOnError(ctx, err, false)
+}
+
+// checkProfiles writes profile files with write, commits and pushes them to info.Branch when they differ from the checked
+// out ones, info.SHA is set to the pushed commit; when push is rejected because the branch moved, working tree is reset
+// to the new tip, reload is called (when set) and profiles are written again, at most push_retries times
+func checkProfiles(ctx context.Context, info *commitInfo, write, reload func() bool) bool {
+	for attempt := 1; ; attempt++ {
+		info.SHA = ""
+		if !jobPhase(ctx, phaseSort) || !write() {
+			return false
 		}
-		if fatalOnError(ioutil.WriteFile(fmt.Sprintf("profiles%d.yaml", i+1), data, 0644), false) {
-			return false, false
+		if !jobPhase(ctx, phasePush) {
+			return false
 		}
-	}
-	mPrintf("written %d profile files\n", len(ranges))
-	if checkLastCommit {
-		mPrintf("checking last commit message for [no-callback] flag\n")
-		mPrintf("git log -1\n")
-		status, ok := execCommand([]string{"git", "log", "-1", "--pretty='%s'"}, nil, 1, []int{})
+		mPrintf(ctx, "git status %s\n", gCfg.profilesGlob())
+		status, ok := execCommand(ctx, []string{"git", "status", gCfg.profilesGlob()}, nil, 1, []int{})
 		if !ok {
-			return false, false
+			return false
 		}
-		if strings.Contains(status, "[no-callback]") {
-			mPrintf("no-callback flag is set, returning\n")
-			return true, true
+		if strings.Contains(status, "nothing to commit, working tree clean") {
+			mPrintf(ctx, "Profile YAML files don't need updates\n")
+			return true
 		}
-		mPrintf("no-callback flag is not set, continuying\n")
-	} else {
-		mPrintf("no-callback flag check is off, not checking\n")
-	}
-	mPrintf("git status *.yaml\n")
-	status, ok := execCommand([]string{"git", "status", "*.yaml"}, nil, 1, []int{})
-	if !ok {
-		return false, false
-	}
-	if strings.Contains(status, "nothing to commit, working tree clean") {
-		mPrintf("Profile YAML files don't need updates\n")
-		return true, false
-	}
-	mPrintf("git add *.yaml\n")
-	_, ok = execCommand([]string{"git", "add", "*.yaml"}, nil, 1, []int{})
-	if !ok {
-		return false, false
-	}
-	mPrintf("git config user.name get\n")
-	cfg, ok := execCommand([]string{"git", "config", "--global", "user.name"}, nil, 1, []int{1})
-	if !ok {
-		return false, false
-	}
-	if strings.TrimSpace(cfg) == "" {
-		mPrintf("git config user.name set\n")
-		_, ok = execCommand([]string{"git", "config", "--global", "user.name", os.Getenv("GITDM_GIT_USER")}, nil, 0, []int{})
+		mPrintf(ctx, "git add %s\n", gCfg.profilesGlob())
+		_, ok = execCommand(ctx, []string{"git", "add", gCfg.profilesGlob()}, nil, 1, []int{})
 		if !ok {
-			return false, false
+			return false
 		}
-	}
-	mPrintf("git config user.email get\n")
-	cfg, ok = execCommand([]string{"git", "config", "--global", "user.email"}, nil, 1, []int{1})
-	if !ok {
-		return false, false
-	}
-	if strings.TrimSpace(cfg) == "" {
-		mPrintf("git config user.email set\n")
-		_, ok = execCommand([]string{"git", "config", "--global", "user.email", os.Getenv("GITDM_GIT_EMAIL")}, nil, 0, []int{})
+		msg, err := info.message()
+		if fatalOnError(ctx, err, false) {
+			return false
+		}
+		mPrintf(ctx, "git commit (sign: %s)\n", gCfg.SignCommits)
+		_, ok = execCommand(ctx, commitCommand(msg), nil, 1, []int{})
 		if !ok {
-			return false, false
-		}
-	}
-	mPrintf("git commit\n")
-	_, ok = execCommand(
-		[]string{
-			"git",
-			"commit",
-			"-sm",
-			fmt.Sprintf("%s gitdm-sync @ %s [no-callback]", os.Getenv("GITDM_GITHUB_USER"), time.Now().Format(dateTimeFormat)),
-		},
-		nil,
-		1,
-		[]int{},
-	)
-	if !ok {
-		return false, false
-	}
-	mPrintf("git push\n")
-	_, ok = execCommand(
-		[]string{
-			"git",
-			"push",
-			"--repo",
-			fmt.Sprintf(
-				"https://%s:%s@github.com/%s",
-				os.Getenv("GITDM_GITHUB_USER"),
-				os.Getenv("GITDM_GITHUB_OAUTH"),
-				os.Getenv("GITDM_GITHUB_REPO"),
-			),
-		},
-		nil,
-		0,
-		[]int{},
-	)
-	if !ok {
-		return false, false
+			return false
+		}
+		info.SHA, ok = headSHA(ctx)
+		if !ok {
+			return false
+		}
+		pushed, ok := pushCommit(ctx, info)
+		if !ok {
+			return false
+		}
+		if pushed {
+			jobPushed(ctx, info.SHA)
+			if info.Branch != gCfg.Branch {
+				return true
+			}
+			return recordProduced(ctx, info.SHA)
+		}
+		if attempt > gCfg.PushRetries {
+			fatalf(ctx, false, "push to %s rejected %d times, giving up", info.Branch, attempt)
+			return false
+		}
+		select {
+		case <-time.After(pushRetryDelay(attempt)):
+		case <-jobContext(ctx).Done():
+			fatalOnError(ctx, jobError(ctx, jobContext(ctx).Err()), false)
+			return false
+		}
+		if !resetToRemote(ctx, info.Branch) {
+			return false
+		}
+		if reload != nil && !reload() {
+			return false
+		}
+		removeCurrentYAMLs(ctx)
+		mPrintf(ctx, "retrying push to %s (%d/%d)\n", info.Branch, attempt, gCfg.PushRetries)
 	}
-	return true, false
 }
 
-func removeCurrentYAMLs() {
+func removeCurrentYAMLs(ctx context.Context) {
 	i := 1
 	for {
-		mPrintf("removing profiles%d.yaml\n", i)
-		err := os.Remove(fmt.Sprintf("profiles%d.yaml", i))
+		mPrintf(ctx, "removing %s\n", gCfg.profilesFile(i))
+		err := os.Remove(gCfg.profilesFile(i))
 		if err != nil {
 			break
 		}
@@ -484,14 +491,21 @@ func removeCurrentYAMLs() {
 	}
 }
 
-func getToken() (err error) {
-	auth0URL := os.Getenv("AUTH0_URL")
-	auth0Audience := os.Getenv("AUTH0_AUDIENCE")
-	auth0ClientID := os.Getenv("AUTH0_CLIENT_ID")
-	auth0ClientSecret := os.Getenv("AUTH0_CLIENT_SECRET")
+// requestToken obtains a new Auth0 bearer token, it doesn't change any global state so it is also used by readiness checks
+func requestToken(ctx context.Context) (token string, err error) {
+	defer func() {
+		outcome := outcomeSuccess
+		if err != nil {
+			outcome = outcomeError
+		}
+		gMetrics.tokenRefreshes.WithLabelValues(outcome).Inc()
+	}()
+	auth0URL := gCfg.Auth0URL
+	auth0Audience := gCfg.Auth0Audience
+	auth0ClientID := gCfg.Auth0ClientID
+	auth0ClientSecret := gCfg.Auth0ClientSecret
 	if auth0URL == "" || auth0ClientID == "" || auth0ClientSecret == "" || auth0Audience == "" {
 		err = fmt.Errorf("Cannot obtain auth0 bearer token - all auth0 parameters must be set")
-		fatalOnError(err, false)
 		return
 	}
 	data := fmt.Sprintf(
@@ -505,17 +519,15 @@ func getToken() (err error) {
 	method := http.MethodPost
 	rurl := "/oauth/token"
 	url := auth0URL + rurl
-	req, e := http.NewRequest(method, url, payloadBody)
+	req, e := http.NewRequestWithContext(ctx, method, url, payloadBody)
 	if e != nil {
 		err = fmt.Errorf("new request error: %+v for %s url: %s\n", e, method, rurl)
-		fatalOnError(err, false)
 		return
 	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, e := http.DefaultClient.Do(req)
+	resp, e := gHTTPClient.Do(req)
 	if e != nil {
 		err = fmt.Errorf("do request error: %+v for %s url: %s\n", e, method, rurl)
-		fatalOnError(err, false)
 		return
 	}
 	defer func() {
@@ -525,11 +537,9 @@ func getToken() (err error) {
 		body, e := ioutil.ReadAll(resp.Body)
 		if e != nil {
 			err = fmt.Errorf("ReadAll non-ok request error: %+v for %s url: %s\n", e, method, rurl)
-			fatalOnError(err, false)
 			return
 		}
 		err = fmt.Errorf("Method:%s url:%s status:%d\n%s\n", method, rurl, resp.StatusCode, body)
-		fatalOnError(err, false)
 		return
 	}
 	var rdata struct {
@@ -537,51 +547,76 @@ func getToken() (err error) {
 	}
 	err = json.NewDecoder(resp.Body).Decode(&rdata)
 	if err != nil {
-		fatalOnError(err, false)
 		return
 	}
 	if rdata.Token == "" {
 		err = fmt.Errorf("empty token retuned")
-		fatalOnError(err, false)
 		return
 	}
-	gToken = "Bearer " + rdata.Token
-	mPrintf("Generated new token(%d)\n", len(gToken))
+	token = "Bearer " + rdata.Token
+	gStatus.tokenObtained()
+	return
+}
+
+func getToken(ctx context.Context) (err error) {
+	token, err := requestToken(jobContext(ctx))
+	if err != nil {
+		err = jobError(ctx, err)
+		fatalOnError(ctx, err, false)
+		return
+	}
+	gToken = token
+	mPrintf(ctx, "Generated new token(%d)\n", len(gToken))
 	return
 }
 
-func getProfilesFromDB() (profs []*allOutput, ok bool) {
+// getProfilesFromDB returns all DB profiles, it is used when they are compared with profile files
+func getProfilesFromDB(ctx context.Context) (profs []*allOutput, ok bool) {
+	ok = readProfilesFromDB(ctx, func(prof *allOutput) error {
+		profs = append(profs, prof)
+		return nil
+	})
+	if !ok {
+		profs = nil
+	}
+	return
+}
+
+// readProfilesFromDB calls fn for each DB profile while the response is being received, one profile at a time
+func readProfilesFromDB(ctx context.Context, fn func(*allOutput) error) (ok bool) {
 	if gToken == "" {
-		mPrintf("Obtaining API token\n")
-		err := getToken()
+		mPrintf(ctx, "Obtaining API token\n")
+		err := getToken(ctx)
 		if err != nil {
-			fatalOnError(err, false)
+			fatalOnError(ctx, err, false)
 			return
 		}
 	}
 	method := "GET"
-	url := fmt.Sprintf("%s/v1/affiliation/all", os.Getenv("DA_API_URL"))
+	call := "all"
+	url := fmt.Sprintf("%s/v1/affiliation/all", gCfg.DAAPIURL)
 	for i := 0; i < 2; i++ {
-		mPrintf("DA affiliation API 'all' request\n")
-		req, err := http.NewRequest(method, os.ExpandEnv(url), nil)
+		mPrintf(ctx, "DA affiliation API 'all' request\n")
+		req, err := http.NewRequestWithContext(jobContext(ctx), method, os.ExpandEnv(url), nil)
 		if err != nil {
 			err = fmt.Errorf("new request error: %+v for %s url: %s\n", err, method, url)
-			fatalOnError(err, false)
+			fatalOnError(ctx, err, false)
 			return
 		}
 		req.Header.Set("Authorization", gToken)
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := gHTTPClient.Do(req)
 		if err != nil {
-			err = fmt.Errorf("do request error: %+v for %s url: %s\n", err, method, url)
-			fatalOnError(err, false)
+			err = jobError(ctx, fmt.Errorf("do request error: %+v for %s url: %s\n", err, method, url))
+			fatalOnError(ctx, err, false)
 			return
 		}
 		if i == 0 && resp.StatusCode == 401 {
 			_ = resp.Body.Close()
-			mPrintf("Token is invalid, trying to generate another one\n")
-			err = getToken()
+			mWarnf(ctx, "Token is invalid, trying to generate another one\n")
+			gMetrics.unauthorizedRetries.WithLabelValues(call).Inc()
+			err = getToken(ctx)
 			if err != nil {
-				fatalOnError(err, false)
+				fatalOnError(ctx, err, false)
 				return
 			}
 			continue
@@ -591,40 +626,45 @@ func getProfilesFromDB() (profs []*allOutput, ok bool) {
 			_ = resp.Body.Close()
 			if err != nil {
 				err = fmt.Errorf("ReadAll non-ok request error: %+v for %s url: %s\n", err, method, url)
-				fatalOnError(err, false)
+				fatalOnError(ctx, err, false)
 				return
 			}
 			err = fmt.Errorf("Method:%s url:%s status:%d\n%s\n", method, url, resp.StatusCode, body)
-			fatalOnError(err, false)
+			fatalOnError(ctx, err, false)
 			return
 		}
-		var payload allArrayOutput
-		err = yaml.NewDecoder(resp.Body).Decode(&payload)
-		_ = resp.Body.Close()
-		if err != nil {
-			body, err2 := ioutil.ReadAll(resp.Body)
-			if err2 != nil {
-				err2 = fmt.Errorf("ReadAll yaml request error: %+v, %+v for %s url: %s\n", err, err2, method, url)
-				fatalOnError(err, false)
-				return
+		n := 0
+		d := newProfileDecoder(resp.Body, "response")
+		for {
+			var prof *allOutput
+			prof, _, err = d.next()
+			if err != nil {
+				break
+			}
+			if err = fn(prof); err != nil {
+				break
 			}
-			err = fmt.Errorf("yaml decode error: %+v for %s url: %s\nBody: %s\n", err, method, url, body)
-			fatalOnError(err, false)
+			n++
+		}
+		_ = resp.Body.Close()
+		if err != io.EOF {
+			err = fmt.Errorf("yaml decode error: %+v for %s url: %s\n", jobError(ctx, err), method, url)
+			fatalOnError(ctx, err, false)
 			return
 		}
 		ok = true
-		profs = payload.Profiles
+		gMetrics.profilesRead.WithLabelValues("db").Add(float64(n))
 		break
 	}
 	return
 }
 
-func updateDB(addDB, delDB []*allOutput) (ok bool) {
+func updateDB(ctx context.Context, addDB, delDB []*allOutput) (text string, ok bool) {
 	if gToken == "" {
-		mPrintf("Obtaining API token\n")
-		err := getToken()
+		mPrintf(ctx, "Obtaining API token\n")
+		err := getToken(ctx)
 		if err != nil {
-			fatalOnError(err, false)
+			fatalOnError(ctx, err, false)
 			return
 		}
 	}
@@ -634,34 +674,36 @@ func updateDB(addDB, delDB []*allOutput) (ok bool) {
 	payloadBytes, err := yaml.Marshal(update)
 	if err != nil {
 		err = fmt.Errorf("YAML marshall error: %+v: %+v\n", err, update)
-		fatalOnError(err, false)
+		fatalOnError(ctx, err, false)
 		return
 	}
 	payloadBody := bytes.NewReader(payloadBytes)
 	method := "POST"
-	url := fmt.Sprintf("%s/v1/affiliation/bulk_update", os.Getenv("DA_API_URL"))
+	call := "bulk_update"
+	url := fmt.Sprintf("%s/v1/affiliation/bulk_update", gCfg.DAAPIURL)
 	for i := 0; i < 2; i++ {
-		mPrintf("DA affiliation API 'bulk_update' request\n")
-		req, err := http.NewRequest(method, os.ExpandEnv(url), payloadBody)
+		mPrintf(ctx, "DA affiliation API 'bulk_update' request\n")
+		req, err := http.NewRequestWithContext(jobContext(ctx), method, os.ExpandEnv(url), payloadBody)
 		if err != nil {
 			err = fmt.Errorf("new request error: %+v for %s url: %s, payload: %s\n", err, method, url, string(payloadBytes))
-			fatalOnError(err, false)
+			fatalOnError(ctx, err, false)
 			return
 		}
 		req.Header.Set("Content-Type", "application/yaml")
 		req.Header.Set("Authorization", gToken)
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := gHTTPClient.Do(req)
 		if err != nil {
-			err = fmt.Errorf("do request error: %+v for %s url: %s, payload: %s\n", err, method, url, string(payloadBytes))
-			fatalOnError(err, false)
+			err = jobError(ctx, fmt.Errorf("do request error: %+v for %s url: %s, payload: %s\n", err, method, url, string(payloadBytes)))
+			fatalOnError(ctx, err, false)
 			return
 		}
 		if i == 0 && resp.StatusCode == 401 {
 			_ = resp.Body.Close()
-			mPrintf("Token is invalid, trying to generate another one\n")
-			err = getToken()
+			mWarnf(ctx, "Token is invalid, trying to generate another one\n")
+			gMetrics.unauthorizedRetries.WithLabelValues(call).Inc()
+			err = getToken(ctx)
 			if err != nil {
-				fatalOnError(err, false)
+				fatalOnError(ctx, err, false)
 				return
 			}
 			continue
@@ -671,11 +713,11 @@ func updateDB(addDB, delDB []*allOutput) (ok bool) {
 			_ = resp.Body.Close()
 			if err != nil {
 				err = fmt.Errorf("ReadAll non-ok request error: %+v for %s url: %s, payload: %s\n", err, method, url, string(payloadBytes))
-				fatalOnError(err, false)
+				fatalOnError(ctx, err, false)
 				return
 			}
 			err = fmt.Errorf("Method:%s url:%s status:%d payload: %s\n%s\n", method, url, resp.StatusCode, string(payloadBytes), body)
-			fatalOnError(err, false)
+			fatalOnError(ctx, err, false)
 			return
 		}
 		var payload textStatusOutput
@@ -685,253 +727,422 @@ func updateDB(addDB, delDB []*allOutput) (ok bool) {
 			body, err2 := ioutil.ReadAll(resp.Body)
 			if err2 != nil {
 				err2 = fmt.Errorf("ReadAll yaml request error: %+v, %+v for %s url: %s, payload: %s\n", err, err2, method, url, string(payloadBytes))
-				fatalOnError(err, false)
+				fatalOnError(ctx, err, false)
 				return
 			}
 			err = fmt.Errorf("yaml decode error: %+v for %s url: %s, payload: %s\nBody: %s\n", err, method, url, string(payloadBytes), body)
-			fatalOnError(err, false)
+			fatalOnError(ctx, err, false)
 			return
 		}
-		mPrintf("API result: %s\n", payload.Text)
+		mPrintf(ctx, "API result: %s\n", payload.Text)
+		text = payload.Text
 		ok = true
 		break
 	}
 	return
 }
 
-func getProfilesFromYAMLs() (profs []*allOutput, ok bool) {
-	i := 1
+// shardProfiles are decoded profiles of a single profile file
+type shardProfiles struct {
+	profs []*allOutput
+	locs  []profileLocation
+	err   error
+}
+
+func readShard(ctx context.Context, name string) (res shardProfiles) {
+	f, err := os.Open(name)
+	if err != nil {
+		res.err = err
+		return
+	}
+	defer func() { _ = f.Close() }()
+	mPrintf(ctx, "reading %s\n", name)
+	d := newProfileDecoder(f, name)
 	for {
-		mPrintf("reading profiles%d.yaml\n", i)
-		data, err := ioutil.ReadFile(fmt.Sprintf("profiles%d.yaml", i))
+		prof, line, err := d.next()
+		if err == io.EOF {
+			return
+		}
 		if err != nil {
+			res.err = err
+			return
+		}
+		res.profs = append(res.profs, prof)
+		res.locs = append(res.locs, profileLocation{File: name, Line: line})
+	}
+}
+
+// readProfileShards calls fn for each profile of profile files with its location, in files order;
+// files are decoded by workers concurrently, at most workers decoded files wait to be processed
+func readProfileShards(ctx context.Context, fn func(*allOutput, profileLocation) error) error {
+	var names []string
+	for i := 1; ; i++ {
+		name := gCfg.profilesFile(i)
+		if _, err := os.Stat(name); err != nil {
 			break
 		}
-		var all allArrayOutput
-		mPrintf("parse profiles%d.yaml\n", i)
-		err = yaml.Unmarshal(data, &all)
-		if err != nil {
-			err = errors.Wrap(err, fmt.Sprintf("profiles%d.yaml", i))
+		names = append(names, name)
+	}
+	results := make([]chan shardProfiles, len(names))
+	start := func(i int) {
+		results[i] = make(chan shardProfiles, 1)
+		go func() { results[i] <- readShard(ctx, names[i]) }()
+	}
+	for i := 0; i < len(names) && i < gCfg.Workers; i++ {
+		start(i)
+	}
+	for i := range names {
+		res := <-results[i]
+		if i+gCfg.Workers < len(names) {
+			start(i + gCfg.Workers)
 		}
-		if fatalOnError(err, false) {
-			return
+		// channels are buffered, so workers still running on error don't leak
+		if res.err != nil {
+			return res.err
+		}
+		for j, prof := range res.profs {
+			gMetrics.profilesRead.WithLabelValues("yaml").Inc()
+			if err := fn(prof, res.locs[j]); err != nil {
+				return err
+			}
 		}
-		profs = append(profs, all.Profiles...)
-		i++
+	}
+	return nil
+}
+
+// getProfilesWithLocations returns all profiles and shard file location of each of them
+func getProfilesWithLocations(ctx context.Context) (profs []*allOutput, locs []profileLocation, err error) {
+	err = readProfileShards(ctx, func(prof *allOutput, loc profileLocation) error {
+		profs = append(profs, prof)
+		locs = append(locs, loc)
+		return nil
+	})
+	return
+}
+
+func getProfilesFromYAMLs(ctx context.Context) (profs []*allOutput, ok bool) {
+	profs, _, err := getProfilesWithLocations(ctx)
+	if fatalOnError(ctx, err, false) {
+		return
 	}
 	ok = true
 	return
 }
 
-func syncFromDB(caller string) bool {
-	mPrintf("syncinf from DB caller: %s\n", caller)
-	profs, ok := getProfilesFromDB()
+func syncFromDB(ctx context.Context, info *commitInfo) bool {
+	mPrintf(ctx, "syncinf from DB caller: %s\n", info.Caller)
+	if !jobPhase(ctx, phaseParse) {
+		return false
+	}
+	profsYAML, ok := getProfilesFromYAMLs(ctx)
 	if !ok {
 		return false
 	}
-	removeCurrentYAMLs()
-	ok, _ = checkProfiles(profs, false)
+	rules, ok := getDomainRules(ctx)
 	if !ok {
 		return false
 	}
-	mPrintf("processing repo finished\n")
+	if !jobPhase(ctx, phaseAPI) {
+		return false
+	}
+	if gCfg.DBSyncMode == "pr" {
+		profs, ok := getProfilesFromDB(ctx)
+		if !ok {
+			return false
+		}
+		// enrollments sent to DB by push syncs because of domain rules don't belong to profile files
+		profs = stripDomainRules(ctx, profs, profsYAML, rules)
+		info.countChanges(profsYAML, profs)
+		removeCurrentYAMLs(ctx)
+		if !syncFromDBWithPR(ctx, info, profsYAML, profs) {
+			return false
+		}
+		gStatus.recordSync(ctx, true, info.SHA)
+		return true
+	}
+	// DB profiles are streamed from the response to the sorter, only their keys are kept to count changes
+	_, applied := withDomainRules(profsYAML, rules)
+	sorter := newProfileSorter(ctx, gCfg.SortRunSize)
+	defer sorter.close()
+	var keys []string
+	stripped := 0
+	ok = readProfilesFromDB(ctx, func(prof *allOutput) error {
+		orig := stripDomainRule(prof, applied)
+		if orig != prof {
+			stripped++
+		}
+		keys = append(keys, orig.sortKey())
+		return sorter.add(orig)
+	})
+	if !ok {
+		return false
+	}
+	mPrintf(ctx, "domain rules enrollments removed from %d DB profiles\n", stripped)
+	info.countKeys(profsYAML, keys)
+	removeCurrentYAMLs(ctx)
+	// DB state wins over commits pushed meanwhile, only changes counts are updated
+	write := func() bool {
+		return writeSortedProfiles(ctx, sorter)
+	}
+	reload := func() bool {
+		profsYAML, ok := getProfilesFromYAMLs(ctx)
+		if ok {
+			info.countKeys(profsYAML, keys)
+		}
+		return ok
+	}
+	if !checkProfiles(ctx, info, write, reload) {
+		return false
+	}
+	// DB state is now the tree of the pushed commit or of the unchanged head
+	head, ok := headSHA(ctx)
+	if !ok {
+		return false
+	}
+	if !recordSynced(ctx, head) {
+		return false
+	}
+	gStatus.recordSync(ctx, true, head)
+	mPrintf(ctx, "processing repo finished\n")
 	return true
 }
 
-func syncRepoAndUpdateDB(caller string) bool {
-	profsYAML, ok := getProfilesFromYAMLs()
+func syncRepoAndUpdateDB(ctx context.Context, info *commitInfo) bool {
+	head, ok := headSHA(ctx)
 	if !ok {
 		return false
 	}
-	removeCurrentYAMLs()
-	ok, flag := checkProfiles(profsYAML, true)
+	synced, ok := alreadySynced(ctx, head)
 	if !ok {
 		return false
 	}
-	if flag {
+	if synced {
+		mPrintf(ctx, "%s is already synced to DB, nothing to do\n", head)
 		return true
 	}
-	profsDB, ok := getProfilesFromDB()
+	if !jobPhase(ctx, phaseParse) {
+		return false
+	}
+	profsYAML, ok := getProfilesFromYAMLs(ctx)
+	if !ok {
+		return false
+	}
+	// profiles are only reordered and resharded here, on push conflict they are reloaded from the new tip
+	info.countChanges(profsYAML, profsYAML)
+	removeCurrentYAMLs(ctx)
+	write := func() bool {
+		return writeProfiles(ctx, profsYAML)
+	}
+	reload := func() bool {
+		profsYAML, ok = getProfilesFromYAMLs(ctx)
+		if ok {
+			info.countChanges(profsYAML, profsYAML)
+		}
+		return ok
+	}
+	if !checkProfiles(ctx, info, write, reload) {
+		return false
+	}
+	rules, ok := getDomainRules(ctx)
+	if !ok {
+		return false
+	}
+	if !jobPhase(ctx, phaseAPI) {
+		return false
+	}
+	profsDB, ok := getProfilesFromDB(ctx)
+	if !ok {
+		return false
+	}
+	head, ok = headSHA(ctx)
 	if !ok {
 		return false
 	}
-	ok = syncProfilesToDB(profsYAML, profsDB)
+	ok = syncProfilesToDB(ctx, info, head, applyDomainRules(ctx, profsYAML, rules), profsDB)
 	if !ok {
 		return false
 	}
-	mPrintf("processing repo finished\n")
+	if !recordSynced(ctx, head) {
+		return false
+	}
+	gStatus.recordSync(ctx, false, head)
+	mPrintf(ctx, "processing repo finished\n")
 	return true
 }
 
-func checkRepo() bool {
-	i := 1
-	for {
-		mPrintf("reading profiles%d.yaml\n", i)
-		data, err := ioutil.ReadFile(fmt.Sprintf("profiles%d.yaml", i))
-		if err != nil {
-			break
-		}
-		var all allArrayOutput
-		mPrintf("parse profiles%d.yaml\n", i)
-		err = yaml.Unmarshal(data, &all)
-		if err != nil {
-			err = errors.Wrap(err, fmt.Sprintf("profiles%d.yaml", i))
-		}
-		if fatalOnError(err, false) {
-			return false
-		}
-		i++
+func checkRepo(ctx context.Context) bool {
+	findings, ok := validateRepo(ctx)
+	if !ok {
+		return false
 	}
-	mPrintf("checking repo finished\n")
+	if len(findings) > 0 {
+		fatalf(ctx, false, "%d validation error(s):\n%s", len(findings), findingsText(findings))
+		return false
+	}
+	mPrintf(ctx, "checking repo finished\n")
 	return true
 }
 
-func handlePR(w http.ResponseWriter, req *http.Request) {
-	info := requestInfo(req)
-	mPrintf("Request: %s\n", info)
-	var err error
-	defer func() {
-		mPrintf("Request(exit): %s err:%v\n", info, err)
-	}()
-	mPrintf("lock mutex\n")
-	gMtx.Lock()
+// checkCommand: gitdm-sync check - validates profile files in the current directory
+func checkCommand(ctx context.Context, args []string) bool {
+	return checkRepo(ctx)
+}
+
+// inClonedRepo clones the repo, checks out a given commit SHA (if not empty) and runs fn inside the clone
+func inClonedRepo(ctx context.Context, sha string, fn func() bool) bool {
+	mPrintf(ctx, "Cleanup repo before\n")
+	execCommand(ctx, []string{"rm", "-rf", "gitdm"}, nil, 1, []int{})
 	defer func() {
-		mPrintf("unlock mutex\n")
-		gMtx.Unlock()
+		// cleanup must not depend on the job context, which may be already cancelled
+		mPrintf(ctx, "Cleanup repo after\n")
+		fatalOnError(ctx, os.RemoveAll("gitdm"), false)
 	}()
-	gw = w
-	path := html.EscapeString(req.URL.Path)
-	// /pr/refs/pull/1/merge
-	ary := strings.Split(path, "/")
-	if len(ary) != 6 {
-		fatalf(false, "malformed path:%s", path)
-		return
-	}
-	prNumber, err := strconv.ParseInt(strings.TrimSpace(ary[4]), 10, 64)
-	if err != nil {
-		fatalf(false, "no PR number specified in path:%s:%v", path, err)
-		return
+	if !jobPhase(ctx, phaseClone) {
+		return false
 	}
-	mPrintf("checking PR %d\n", prNumber)
-	mPrintf("Cleanup repo before\n")
-	execCommand([]string{"rm", "-rf", "gitdm"}, nil, 1, []int{})
-	defer func() {
-		mPrintf("Cleanup repo after\n")
-		execCommand([]string{"rm", "-rf", "gitdm"}, nil, 1, []int{})
-	}()
-	mPrintf("git clone\n")
+	mPrintf(ctx, "git clone\n")
 	cmd := []string{
 		"git",
 		"clone",
 		"--depth",
 		"1",
-		fmt.Sprintf(
-			"https://%s:%s@github.com/%s",
-			os.Getenv("GITDM_GITHUB_USER"),
-			os.Getenv("GITDM_GITHUB_OAUTH"),
-			os.Getenv("GITDM_GITHUB_REPO"),
-		),
-	}
-	env := map[string]string{"GIT_TERMINAL_PROMPT": "0"}
-	execCommand(cmd, env, 0, []int{})
-	mPrintf("get wd\n")
+		"--branch",
+		gCfg.Branch,
+		githubRepoURL(),
+	}
+	_, ok := execCommand(ctx, cmd, nil, 1, []int{})
+	if !ok {
+		return false
+	}
+	mPrintf(ctx, "get wd\n")
 	wd, err := os.Getwd()
-	if fatalOnError(err, false) {
-		return
+	if fatalOnError(ctx, err, false) {
+		return false
 	}
-	mPrintf("chdir gitdm\n")
-	if fatalOnError(os.Chdir("gitdm"), false) {
-		return
+	mPrintf(ctx, "chdir gitdm\n")
+	if fatalOnError(ctx, os.Chdir("gitdm"), false) {
+		return false
 	}
 	defer func() {
-		mPrintf("chdir back to %s\n", wd)
+		mPrintf(ctx, "chdir back to %s\n", wd)
 		_ = os.Chdir(wd)
 	}()
-	mPrintf("git fetch origin\n")
-	_, ok := execCommand([]string{"git", "fetch", "origin", fmt.Sprintf("pull/%d/head:gitdm-sync-%d", prNumber, prNumber)}, nil, 1, []int{})
+	if sha != "" {
+		mPrintf(ctx, "git fetch %s\n", sha)
+		_, ok = execCommand(ctx, []string{"git", "fetch", "--depth", "1", "origin", sha}, nil, 1, []int{})
+		if !ok {
+			return false
+		}
+		mPrintf(ctx, "git checkout %s\n", sha)
+		_, ok = execCommand(ctx, []string{"git", "checkout", "--detach", sha}, nil, 1, []int{})
+		if !ok {
+			return false
+		}
+	}
+	return fn()
+}
+
+func handlePR(w http.ResponseWriter, req *http.Request) {
+	info := requestInfo(req)
+	reqPrintf(req, "Request: %s\n", info)
+	// endJob is deferred later, so it runs first and job outcome is final here
+	var j *job
+	defer func() {
+		reqPrintf(req, "Request(exit): %s outcome:%s\n", info, j.result())
+	}()
+	j, ok := beginJob(w, req, "pr")
+	defer endJob(j)
+	ctx := j.ctx
 	if !ok {
 		return
 	}
-	mPrintf("git checkout\n")
-	_, ok = execCommand([]string{"git", "checkout", fmt.Sprintf("gitdm-sync-%d", prNumber)}, nil, 1, []int{})
-	if !ok {
+	if req.Method == http.MethodPost && req.Header.Get("X-GitHub-Event") == "pull_request" {
+		// GitHub webhook, checked at the event's head SHA as by /webhook
+		var ev githubPullRequestEvent
+		if fatalOnError(ctx, json.NewDecoder(req.Body).Decode(&ev), false) {
+			return
+		}
+		webhookPR(ctx, w, &ev)
 		return
 	}
-	defer func() {
-		_, _ = execCommand([]string{"git", "checkout", "master"}, nil, 1, []int{})
-	}()
-	mPrintf("check repo PR %d\n", prNumber)
-	if !checkRepo() {
+	path := html.EscapeString(req.URL.Path)
+	// /pr/refs/pull/1/merge
+	ary := strings.Split(path, "/")
+	if len(ary) != 6 {
+		fatalf(ctx, false, "malformed path:%s", path)
+		return
+	}
+	prNumber, err := strconv.ParseInt(strings.TrimSpace(ary[4]), 10, 64)
+	if err != nil {
+		fatalf(ctx, false, "no PR number specified in path:%s:%v", path, err)
+		return
+	}
+	mWarnf(ctx, "%s is deprecated, PR is checked at its current head instead of the triggering commit, use /webhook\n", path)
+	j.setPR(prNumber)
+	mPrintf(ctx, "checking PR %d\n", prNumber)
+	ok = inClonedRepo(ctx, "", func() bool {
+		mPrintf(ctx, "git fetch origin\n")
+		_, ok := execCommand(ctx, []string{"git", "fetch", "origin", fmt.Sprintf("pull/%d/head:gitdm-sync-%d", prNumber, prNumber)}, nil, 1, []int{})
+		if !ok {
+			return false
+		}
+		mPrintf(ctx, "git checkout\n")
+		_, ok = execCommand(ctx, []string{"git", "checkout", fmt.Sprintf("gitdm-sync-%d", prNumber)}, nil, 1, []int{})
+		if !ok {
+			return false
+		}
+		defer func() {
+			_, _ = execCommand(ctx, []string{"git", "checkout", gCfg.Branch}, nil, 1, []int{})
+		}()
+		sha, ok := headSHA(ctx)
+		if !ok {
+			return false
+		}
+		mPrintf(ctx, "check repo PR %d at %s\n", prNumber, sha)
+		return checkPR(ctx, sha)
+	})
+	if !ok {
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	_, _ = io.WriteString(w, "CHECK_OK")
 }
 
-func executeInCloned(w http.ResponseWriter, req *http.Request, fn func(string) bool, msg [2]string) {
+func executeInCloned(w http.ResponseWriter, req *http.Request, kind string, fn func(context.Context, *commitInfo) bool, msg [2]string) {
 	info := requestInfo(req)
-	mPrintf("Request: %s\n", info)
-	var err error
+	reqPrintf(req, "Request: %s\n", info)
+	// endJob is deferred later, so it runs first and job outcome is final here
+	var j *job
 	defer func() {
-		mPrintf("Request(exit): %s err:%v\n", info, err)
+		reqPrintf(req, "Request(exit): %s outcome:%s\n", info, j.result())
 	}()
-	mPrintf("lock mutex\n")
-	gMtx.Lock()
-	defer func() {
-		mPrintf("unlock mutex\n")
-		gMtx.Unlock()
-	}()
-	gw = w
+	j, ok := beginJob(w, req, kind)
+	defer endJob(j)
+	ctx := j.ctx
+	if !ok {
+		return
+	}
 	caller := ""
-	if msg[0] == "sync from DB" {
+	if kind == "sync-from-db" {
 		path := html.EscapeString(req.URL.Path)
 		// /sync-from-db/ori
 		ary := strings.Split(path, "/")
 		if len(ary) != 3 {
-			fatalf(false, "malformed path:%s", path)
+			fatalf(ctx, false, "malformed path:%s", path)
 			return
 		}
 		caller = ary[2]
 	} else {
 		// push from GitHub
 		caller = "github"
+		mWarnf(ctx, "/push is deprecated, it syncs the current branch tip instead of the pushed commit, use /webhook\n")
 	}
-	mPrintf("Cleanup repo before\n")
-	execCommand([]string{"rm", "-rf", "gitdm"}, nil, 1, []int{})
-	defer func() {
-		mPrintf("Cleanup repo after\n")
-		execCommand([]string{"rm", "-rf", "gitdm"}, nil, 1, []int{})
-	}()
-	mPrintf("git clone\n")
-	cmd := []string{
-		"git",
-		"clone",
-		"--depth",
-		"1",
-		fmt.Sprintf(
-			"https://%s:%s@github.com/%s",
-			os.Getenv("GITDM_GITHUB_USER"),
-			os.Getenv("GITDM_GITHUB_OAUTH"),
-			os.Getenv("GITDM_GITHUB_REPO"),
-		),
-	}
-	env := map[string]string{"GIT_TERMINAL_PROMPT": "0"}
-	execCommand(cmd, env, 0, []int{})
-	mPrintf("get wd\n")
-	wd, err := os.Getwd()
-	if fatalOnError(err, false) {
-		return
-	}
-	mPrintf("chdir gitdm\n")
-	if fatalOnError(os.Chdir("gitdm"), false) {
-		return
-	}
-	defer func() {
-		mPrintf("chdir back to %s\n", wd)
-		_ = os.Chdir(wd)
-	}()
-	mPrintf(msg[0] + "\n")
-	if !fn(caller) {
+	j.setCaller(caller)
+	ok = inClonedRepo(ctx, "", func() bool {
+		mPrintf(ctx, "%s\n", msg[0])
+		return fn(ctx, newCommitInfo(msg[0], caller))
+	})
+	if !ok {
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -939,54 +1150,95 @@ func executeInCloned(w http.ResponseWriter, req *http.Request, fn func(string) b
 }
 
 func handlePush(w http.ResponseWriter, req *http.Request) {
-	executeInCloned(w, req, syncRepoAndUpdateDB, [2]string{"sync repo", "SYNC_OK"})
+	executeInCloned(w, req, "push", syncRepoAndUpdateDB, [2]string{"sync repo", "SYNC_OK"})
 }
 
 func handleSyncFromDB(w http.ResponseWriter, req *http.Request) {
-	executeInCloned(w, req, syncFromDB, [2]string{"sync from DB", "SYNC_DB_OK"})
+	executeInCloned(w, req, "sync-from-db", syncFromDB, [2]string{"sync from DB", "SYNC_DB_OK"})
 }
 
-func checkEnv() {
-	requiredEnv := []string{
-		"DA_API_URL",
-		"GITDM_GITHUB_REPO",
-		"GITDM_GITHUB_USER",
-		"GITDM_GITHUB_OAUTH",
-		"GITDM_GIT_USER",
-		"GITDM_GIT_EMAIL",
-		"AUTH0_URL",
-		"AUTH0_AUDIENCE",
-		"AUTH0_CLIENT_ID",
-		"AUTH0_CLIENT_SECRET",
-	}
-	for _, env := range requiredEnv {
-		if os.Getenv(env) == "" {
-			fatalf(true, "%s env variable must be set", env)
-		}
+// serve runs the sync server until it is stopped by a signal, it returns true when it was stopped cleanly
+func serve(ctx context.Context) bool {
+	mPrintf(ctx, "Starting sync server\n")
+	gToken = gCfg.JWTToken
+	setupGitCredentials(ctx)
+	gMtx = &sync.Mutex{}
+	http.HandleFunc("/push", authorized(handlePush))
+	http.HandleFunc("/pr/", authorized(handlePR))
+	http.HandleFunc("/sync-from-db/", authorized(handleSyncFromDB))
+	http.HandleFunc("/webhook", authorized(handleWebhook))
+	http.HandleFunc("/config", authorized(handleConfig))
+	http.HandleFunc("/metrics", authorized(promhttp.Handler().ServeHTTP))
+	http.HandleFunc("/status", authorized(handleStatus))
+	http.HandleFunc("/audit", authorized(handleAudit))
+	http.HandleFunc("/rollback/", authorized(handleRollback))
+	http.HandleFunc("/drift", authorized(handleDrift))
+	// probes can't authenticate, they don't return any sensitive data
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	gHTTPClient = &http.Client{Timeout: gCfg.HTTPTimeout}
+	srv := &http.Server{Addr: gCfg.ListenAddr, ReadTimeout: gCfg.ReadTimeout, WriteTimeout: gCfg.WriteTimeout}
+	done := make(chan bool, 1)
+	handleSignals(srv, done)
+	if gCfg.DriftCheckInterval > 0 {
+		scheduleDriftChecks()
+	}
+	mPrintf(ctx, "listening on %s\n", gCfg.ListenAddr)
+	err := srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		fatalOnError(ctx, err, false)
+		return false
 	}
-	gToken = os.Getenv("JWT_TOKEN")
+	return <-done
 }
 
-func serve() {
-	mPrintf("Starting sync server\n")
-	checkEnv()
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGALRM)
-	go func() {
-		for {
-			sig := <-sigs
-			mPrintf("Exiting due to signal %v\n", sig)
-			os.Exit(1)
+var commands = map[string]func(context.Context, []string) bool{
+	"affiliation":   affiliationCommand,
+	"audit":         auditCommand,
+	"check":         checkCommand,
+	"drift":         driftCommand,
+	"duplicates":    duplicatesCommand,
+	"fix-orgs":      fixOrgsCommand,
+	"history":       historyCommand,
+	"init-orgs":     initOrgsCommand,
+	"init-projects": initProjectsCommand,
+	"merge":         mergeCommand,
+	"profile-at":    profileAtCommand,
+	"reshard":       reshardCommand,
+	"rollback":      rollbackCommand,
+}
+
+func runCommand(ctx context.Context, args []string) bool {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
 		}
-	}()
-	gMtx = &sync.Mutex{}
-	http.HandleFunc("/push", handlePush)
-	http.HandleFunc("/pr/", handlePR)
-	http.HandleFunc("/sync-from-db/", handleSyncFromDB)
-	fatalOnError(http.ListenAndServe("0.0.0.0:7070", nil), true)
+		sort.Strings(names)
+		fatalf(ctx, false, "unknown command '%s', available commands: %s", args[0], strings.Join(names, ", "))
+		return false
+	}
+	return cmd(ctx, args[1:])
 }
 
 func main() {
-	serve()
-	fatalf(true, "serve exited without error, returning error state anyway")
+	if askpass(os.Args[1:]) {
+		return
+	}
+	ctx := context.Background()
+	cfg, ok := loadConfig(ctx, len(os.Args) == 1)
+	if !ok {
+		os.Exit(1)
+	}
+	gCfg = cfg
+	if len(os.Args) > 1 {
+		if !runCommand(ctx, os.Args[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
+	if !serve(ctx) {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// testGit runs git in dir with a fixed identity and returns its output
+func testGit(t testing.TB, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@a.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+// testGitRepo creates a local bare repo with profs written to profile files on the master branch and makes
+// the current directory its clone, pushes to the configured GitHub repo go to the bare repo, returns its path
+func testGitRepo(t *testing.T, profs []*allOutput) string {
+	saved := gCfg
+	t.Cleanup(func() { gCfg = saved })
+	cfg := *saved
+	cfg.LogLevel, cfg.Branch, cfg.GitHubRepo, cfg.GitHubUser = levelWarn, "master", "o/r", "gitdm-bot"
+	cfg.GitUser, cfg.GitEmail, cfg.SignCommits, cfg.DataDir = "Bot", "bot@a.com", "none", t.TempDir()
+	gCfg = &cfg
+	dir := t.TempDir()
+	bare, work := filepath.Join(dir, "bare.git"), filepath.Join(dir, "work")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", "/dev/null")
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "url."+bare+".insteadOf")
+	t.Setenv("GIT_CONFIG_VALUE_0", githubRepoURL())
+	testGit(t, dir, "init", "-q", "--bare", "-b", "master", bare)
+	testGit(t, dir, "init", "-q", "-b", "master", work)
+	t.Chdir(work)
+	if !writeProfiles(context.Background(), profs) {
+		t.Fatal("writing profiles failed")
+	}
+	testGit(t, work, "add", ".")
+	testGit(t, work, "commit", "-q", "-m", "profiles")
+	testGit(t, work, "remote", "add", "origin", bare)
+	testGit(t, work, "push", "-q", "origin", "master")
+	return bare
+}
+
+// testDAAPI is a stateful stub of Auth0 and DA affiliation API, bulk updates are applied to profs
+type testDAAPI struct {
+	*httptest.Server
+	mtx     sync.Mutex
+	profs   []*allOutput
+	updates []*dbUpdate
+	tokens  int
+}
+
+// newTestDAAPI starts API stub holding profs and points configuration to it, data_dir is a temporary directory
+func newTestDAAPI(t testing.TB, profs []*allOutput) *testDAAPI {
+	api := &testDAAPI{profs: profs}
+	api.Server = httptest.NewServer(http.HandlerFunc(api.handle))
+	saved, savedToken := gCfg, gToken
+	t.Cleanup(func() {
+		api.Close()
+		gCfg, gToken = saved, savedToken
+	})
+	cfg := *saved
+	cfg.DAAPIURL, cfg.Auth0URL = api.URL, api.URL
+	cfg.Auth0ClientID, cfg.Auth0ClientSecret, cfg.Auth0Audience = "id", "secret", "audience"
+	cfg.DataDir = t.TempDir()
+	gCfg, gToken = &cfg, ""
+	return api
+}
+
+func (api *testDAAPI) handle(w http.ResponseWriter, req *http.Request) {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	if req.URL.Path == "/oauth/token" {
+		api.tokens++
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "tok"})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer tok" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch req.URL.Path {
+	case "/v1/affiliation/all":
+		data, _ := yaml.Marshal(&allArrayOutput{Profiles: api.profs})
+		_, _ = w.Write(data)
+	case "/v1/affiliation/bulk_update":
+		var update dbUpdate
+		if err := yaml.NewDecoder(req.Body).Decode(&update); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		api.updates = append(api.updates, &update)
+		del := profileKeys(update.Del)
+		var profs []*allOutput
+		for _, prof := range api.profs {
+			if _, ok := del[prof.sortKey()]; !ok {
+				profs = append(profs, prof)
+			}
+		}
+		api.profs = append(profs, update.Add...)
+		data, _ := yaml.Marshal(&textStatusOutput{Text: "updated"})
+		_, _ = w.Write(data)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// lastUpdate returns the last bulk update received, nil when there was none
+func (api *testDAAPI) lastUpdate() *dbUpdate {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	if len(api.updates) == 0 {
+		return nil
+	}
+	return api.updates[len(api.updates)-1]
+}
+
+func TestSyncProfilesToDB(t *testing.T) {
+	kept, removed, added := testProfile("Kept", "k@a.com", ""), testProfile("Removed", "r@a.com", ""), testProfile("Added", "a@a.com", "")
+	api := newTestDAAPI(t, []*allOutput{kept, removed})
+	ctx := context.Background()
+	profsDB, ok := getProfilesFromDB(ctx)
+	if !ok || len(profsDB) != 2 {
+		t.Fatalf("got %d DB profiles", len(profsDB))
+	}
+	if !syncProfilesToDB(ctx, newCommitInfo("push", "test"), "abc", []*allOutput{kept, added}, profsDB) {
+		t.Fatal("sync failed")
+	}
+	update := api.lastUpdate()
+	if update == nil || len(update.Add) != 1 || *update.Add[0].Name != "Added" || len(update.Del) != 1 || *update.Del[0].Name != "Removed" {
+		t.Fatalf("got update %+v", update)
+	}
+	n := len(api.updates)
+	if !syncProfilesToDB(ctx, newCommitInfo("push", "test"), "abc", []*allOutput{kept, added}, api.profs) || len(api.updates) != n {
+		t.Errorf("DB in sync should not be updated")
+	}
+}
+
+func TestSyncFromDB(t *testing.T) {
+	a, b, c, d := testProfile("A", "a@a.com", ""), testProfile("B", "b@a.com", ""), testProfile("C", "c@a.com", ""), testProfile("D", "d@a.com", "")
+	bare := testGitRepo(t, []*allOutput{a, c})
+	newTestDAAPI(t, []*allOutput{d, a, b})
+	// DB profiles are sorted in runs of one profile, so all of them are spilled and merged
+	gCfg.SortRunSize = 1
+	ctx := context.Background()
+	info := newCommitInfo("sync-from-db", "test")
+	if !syncFromDB(ctx, info) {
+		t.Fatal("sync from DB failed")
+	}
+	if info.Added != 2 || info.Removed != 1 || info.Profiles != 3 {
+		t.Errorf("got %d added, %d removed of %d profiles, want 2, 1 of 3", info.Added, info.Removed, info.Profiles)
+	}
+	head := strings.TrimSpace(testGit(t, bare, "rev-parse", "master"))
+	st, _ := readSyncState(ctx)
+	if info.SHA != head || st.LastSyncedSHA != head {
+		t.Errorf("master is at %s, synced %s, want pushed commit %s", head, st.LastSyncedSHA, info.SHA)
+	}
+	profs, ok := getProfilesFromYAMLs(ctx)
+	if got, want := marshalProfiles(t, profs), marshalProfiles(t, []*allOutput{a, b, d}); !ok || got != want {
+		t.Errorf("got profile files:\n%s\nwant:\n%s", got, want)
+	}
+	// DB in sync with profile files doesn't produce a commit
+	info = newCommitInfo("sync-from-db", "test")
+	if !syncFromDB(ctx, info) || info.SHA != "" {
+		t.Errorf("DB in sync should not be pushed, got commit %q", info.SHA)
+	}
+}
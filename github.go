@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	githubCheckName      = "gitdm-sync"
+	maxGitHubAnnotations = 50
+	maxGitHubDescription = 140
+	maxGitHubCheckText   = 65535
+)
+
+// githubAPI is a subset of GitHub API used to report PR check results and to manage DB sync PRs
+type githubAPI interface {
+	createStatus(sha string, status *githubStatus) error
+	createCheckRun(run *githubCheckRun) (int64, error)
+	updateCheckRun(id int64, run *githubCheckRun) error
+	findPullRequest(branch string) (*githubPullRequest, error)
+	createPullRequest(pr *githubPullRequestInput) (*githubPullRequest, error)
+	updatePullRequest(number int64, pr *githubPullRequestInput) error
+	mergePullRequest(number int64, merge *githubMergeInput) error
+}
+
+type githubStatus struct {
+	State       string `json:"state"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+	TargetURL   string `json:"target_url,omitempty"`
+}
+
+type githubAnnotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Message         string `json:"message"`
+}
+
+type githubCheckOutput struct {
+	Title       string              `json:"title"`
+	Summary     string              `json:"summary"`
+	Text        string              `json:"text,omitempty"`
+	Annotations []*githubAnnotation `json:"annotations,omitempty"`
+}
+
+type githubCheckRun struct {
+	Name       string             `json:"name,omitempty"`
+	HeadSHA    string             `json:"head_sha,omitempty"`
+	Status     string             `json:"status,omitempty"`
+	Conclusion string             `json:"conclusion,omitempty"`
+	Output     *githubCheckOutput `json:"output,omitempty"`
+}
+
+type githubPullRequest struct {
+	Number  int64  `json:"number"`
+	HTMLURL string `json:"html_url"`
+}
+
+type githubPullRequestInput struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	Head  string `json:"head,omitempty"`
+	Base  string `json:"base,omitempty"`
+	State string `json:"state,omitempty"`
+}
+
+type githubMergeInput struct {
+	CommitTitle string `json:"commit_title,omitempty"`
+	MergeMethod string `json:"merge_method"`
+	SHA         string `json:"sha,omitempty"`
+}
+
+// githubClient calls GitHub REST API at url, GITDM_GITHUB_API_URL can point it to GitHub Enterprise or to a local stub;
+// calls are bound to ctx, so they are cancelled with its job's phase
+type githubClient struct {
+	ctx    context.Context
+	url    string
+	repo   string
+	token  string
+	client *http.Client
+}
+
+func newGitHubClient(ctx context.Context, token string) *githubClient {
+	return &githubClient{
+		ctx:    ctx,
+		url:    strings.TrimSuffix(gCfg.GitHubAPIURL, "/"),
+		repo:   gCfg.GitHubRepo,
+		token:  token,
+		client: &http.Client{Timeout: gCfg.HTTPTimeout},
+	}
+}
+
+func (c *githubClient) call(method, path string, payload, result interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	rurl := fmt.Sprintf("%s/repos/%s/%s", c.url, c.repo, path)
+	req, err := http.NewRequestWithContext(jobContext(c.ctx), method, rurl, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return jobError(c.ctx, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: status %d: %s", method, rurl, resp.StatusCode, data)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+func (c *githubClient) createStatus(sha string, status *githubStatus) error {
+	return c.call(http.MethodPost, "statuses/"+sha, status, nil)
+}
+
+func (c *githubClient) createCheckRun(run *githubCheckRun) (int64, error) {
+	var result struct {
+		ID int64 `json:"id"`
+	}
+	err := c.call(http.MethodPost, "check-runs", run, &result)
+	return result.ID, err
+}
+
+func (c *githubClient) updateCheckRun(id int64, run *githubCheckRun) error {
+	return c.call(http.MethodPatch, fmt.Sprintf("check-runs/%d", id), run, nil)
+}
+
+// findPullRequest returns open PR from a given branch of this repository or nil
+func (c *githubClient) findPullRequest(branch string) (*githubPullRequest, error) {
+	owner := strings.SplitN(c.repo, "/", 2)[0]
+	var prs []*githubPullRequest
+	err := c.call(http.MethodGet, "pulls?state=open&head="+url.QueryEscape(owner+":"+branch), nil, &prs)
+	if err != nil || len(prs) == 0 {
+		return nil, err
+	}
+	return prs[0], nil
+}
+
+func (c *githubClient) createPullRequest(pr *githubPullRequestInput) (*githubPullRequest, error) {
+	var result githubPullRequest
+	err := c.call(http.MethodPost, "pulls", pr, &result)
+	return &result, err
+}
+
+func (c *githubClient) updatePullRequest(number int64, pr *githubPullRequestInput) error {
+	return c.call(http.MethodPatch, fmt.Sprintf("pulls/%d", number), pr, nil)
+}
+
+func (c *githubClient) mergePullRequest(number int64, merge *githubMergeInput) error {
+	return c.call(http.MethodPut, fmt.Sprintf("pulls/%d/merge", number), merge, nil)
+}
+
+// checkSummary returns one line result description and markdown list of findings
+func checkSummary(findings []*validationFinding, skipped bool) (summary, text string) {
+	switch {
+	case skipped:
+		summary = "no data files changed, check skipped"
+	case len(findings) == 0:
+		summary = "all profiles and registries are valid"
+	default:
+		summary = fmt.Sprintf("%d validation error(s)", len(findings))
+	}
+	lines := []string{}
+	for _, finding := range findings {
+		lines = append(lines, "- `"+finding.location()+"` "+finding.Message)
+	}
+	text = strings.Join(lines, "\n")
+	text = truncate(text, maxGitHubCheckText, "\n...")
+	return
+}
+
+// truncate returns s cut to at most max bytes (suffix included) on a rune boundary, suffix is only added when cut
+func truncate(s string, max int, suffix string) string {
+	if len(s) <= max {
+		return s
+	}
+	n := max - len(suffix)
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + suffix
+}
+
+func annotations(findings []*validationFinding) (anns []*githubAnnotation) {
+	for _, finding := range findings {
+		line := finding.Line
+		if line < 1 {
+			line = 1
+		}
+		anns = append(
+			anns,
+			&githubAnnotation{Path: finding.File, StartLine: line, EndLine: line, AnnotationLevel: "failure", Message: finding.Message},
+		)
+	}
+	return
+}
+
+// reportCheck publishes check result for a given commit as commit status or as check run with annotations,
+// mode is "status", "check" or "none"
+func reportCheck(api githubAPI, mode, sha string, findings []*validationFinding, skipped bool) error {
+	summary, text := checkSummary(findings, skipped)
+	switch mode {
+	case "none", "":
+		return nil
+	case "status":
+		state := "success"
+		if len(findings) > 0 {
+			state = "failure"
+			summary += ": " + findings[0].String()
+		}
+		summary = truncate(summary, maxGitHubDescription, "...")
+		return api.createStatus(sha, &githubStatus{State: state, Description: summary, Context: githubCheckName, TargetURL: gCfg.GitHubStatusURL})
+	case "check":
+		conclusion := "success"
+		if skipped {
+			conclusion = "neutral"
+		}
+		if len(findings) > 0 {
+			conclusion = "failure"
+		}
+		anns := annotations(findings)
+		first := anns
+		if len(first) > maxGitHubAnnotations {
+			first = first[:maxGitHubAnnotations]
+		}
+		output := &githubCheckOutput{Title: summary, Summary: summary, Text: text, Annotations: first}
+		id, err := api.createCheckRun(&githubCheckRun{Name: githubCheckName, HeadSHA: sha, Status: "completed", Conclusion: conclusion, Output: output})
+		if err != nil {
+			return err
+		}
+		// GitHub accepts up to 50 annotations per request, remaining ones are appended by updates
+		for i := maxGitHubAnnotations; i < len(anns); i += maxGitHubAnnotations {
+			j := i + maxGitHubAnnotations
+			if j > len(anns) {
+				j = len(anns)
+			}
+			err = api.updateCheckRun(id, &githubCheckRun{Output: &githubCheckOutput{Title: summary, Summary: summary, Annotations: anns[i:j]}})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown GitHub report mode '%s'", mode)
+}
+
+// reportCheckToGitHub reports using configured github_report mode,
+// reporting errors are only logged, they don't change check result
+func reportCheckToGitHub(ctx context.Context, sha string, findings []*validationFinding, skipped bool) {
+	mode := gCfg.GitHubReport
+	if mode == "none" || sha == "" {
+		return
+	}
+	if !jobPhase(ctx, phaseAPI) {
+		return
+	}
+	mPrintf(ctx, "reporting check result for %s to GitHub as %s\n", sha, mode)
+	token := gCfg.GitHubChecksToken
+	if token == "" {
+		token = gCfg.GitHubOAuth
+	}
+	err := reportCheck(newGitHubClient(ctx, token), mode, sha, findings, skipped)
+	if err != nil {
+		mWarnf(ctx, "cannot report check result to GitHub: %v\n", err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+// stubGitHub records check results and pull request calls made through githubAPI,
+// pr is the open pull request found for any branch, nil when there is none
+type stubGitHub struct {
+	statuses []*githubStatus
+	created  []*githubCheckRun
+	updated  []*githubCheckRun
+	pr       *githubPullRequest
+	branches []string
+	opened   []*githubPullRequestInput
+	edited   []*githubPullRequestInput
+	merged   []*githubMergeInput
+}
+
+func (s *stubGitHub) createStatus(sha string, status *githubStatus) error {
+	s.statuses = append(s.statuses, status)
+	return nil
+}
+
+func (s *stubGitHub) createCheckRun(run *githubCheckRun) (int64, error) {
+	s.created = append(s.created, run)
+	return 7, nil
+}
+
+func (s *stubGitHub) updateCheckRun(id int64, run *githubCheckRun) error {
+	if id != 7 {
+		return fmt.Errorf("unknown check run %d", id)
+	}
+	s.updated = append(s.updated, run)
+	return nil
+}
+
+func (s *stubGitHub) findPullRequest(branch string) (*githubPullRequest, error) {
+	s.branches = append(s.branches, branch)
+	return s.pr, nil
+}
+
+func (s *stubGitHub) createPullRequest(pr *githubPullRequestInput) (*githubPullRequest, error) {
+	if s.pr != nil {
+		return nil, fmt.Errorf("pull request #%d is already open", s.pr.Number)
+	}
+	s.opened = append(s.opened, pr)
+	s.pr = &githubPullRequest{Number: 12, HTMLURL: "https://github.com/o/r/pull/12"}
+	return s.pr, nil
+}
+
+func (s *stubGitHub) updatePullRequest(number int64, pr *githubPullRequestInput) error {
+	if s.pr == nil || number != s.pr.Number {
+		return fmt.Errorf("unknown pull request #%d", number)
+	}
+	s.edited = append(s.edited, pr)
+	if pr.State == "closed" {
+		s.pr = nil
+	}
+	return nil
+}
+
+func (s *stubGitHub) mergePullRequest(number int64, merge *githubMergeInput) error {
+	if s.pr == nil || number != s.pr.Number {
+		return fmt.Errorf("unknown pull request #%d", number)
+	}
+	s.merged = append(s.merged, merge)
+	s.pr = nil
+	return nil
+}
+
+func testFindings(n int, msg string) (findings []*validationFinding) {
+	for i := 0; i < n; i++ {
+		findings = append(findings, &validationFinding{File: "profiles1.yaml", Line: i, Message: msg})
+	}
+	return
+}
+
+func TestReportCheck(t *testing.T) {
+	long := strings.Repeat("żółć ", 40)
+	var cases = []struct {
+		name        string
+		mode        string
+		findings    []*validationFinding
+		skipped     bool
+		status      string
+		conclusion  string
+		annotations []int
+	}{
+		{name: "disabled", mode: "none", findings: testFindings(1, "bad")},
+		{name: "status success", mode: "status", status: "success"},
+		{name: "status failure", mode: "status", findings: testFindings(2, long), status: "failure"},
+		{name: "check success", mode: "check", conclusion: "success", annotations: []int{0}},
+		{name: "check skipped", mode: "check", skipped: true, conclusion: "neutral", annotations: []int{0}},
+		{name: "check failure", mode: "check", findings: testFindings(3, "bad"), conclusion: "failure", annotations: []int{3}},
+		{name: "check annotations batches", mode: "check", findings: testFindings(120, "bad"), conclusion: "failure", annotations: []int{50, 50, 20}},
+	}
+	for _, c := range cases {
+		api := &stubGitHub{}
+		if err := reportCheck(api, c.mode, "abc", c.findings, c.skipped); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if c.status == "" && len(api.statuses) > 0 || c.status != "" && len(api.statuses) != 1 {
+			t.Errorf("%s: got %d statuses", c.name, len(api.statuses))
+			continue
+		}
+		if c.status != "" {
+			st := api.statuses[0]
+			if st.State != c.status || st.Context != githubCheckName {
+				t.Errorf("%s: got status %+v, want %s", c.name, st, c.status)
+			}
+			if len(st.Description) > maxGitHubDescription || !utf8.ValidString(st.Description) {
+				t.Errorf("%s: description is not truncated on a rune boundary: %q", c.name, st.Description)
+			}
+		}
+		if c.conclusion == "" {
+			if len(api.created) > 0 {
+				t.Errorf("%s: got %d check runs", c.name, len(api.created))
+			}
+			continue
+		}
+		if len(api.created) != 1 || len(api.updated) != len(c.annotations)-1 {
+			t.Errorf("%s: got %d created and %d updated check runs", c.name, len(api.created), len(api.updated))
+			continue
+		}
+		run := api.created[0]
+		if run.Conclusion != c.conclusion || run.HeadSHA != "abc" || run.Status != "completed" {
+			t.Errorf("%s: got check run %+v, want %s", c.name, run, c.conclusion)
+		}
+		for i, n := range c.annotations {
+			out := run.Output
+			if i > 0 {
+				out = api.updated[i-1].Output
+			}
+			if len(out.Annotations) != n {
+				t.Errorf("%s: request %d has %d annotations, want %d", c.name, i, len(out.Annotations), n)
+			}
+		}
+	}
+	if err := reportCheck(&stubGitHub{}, "comment", "abc", nil, false); err == nil {
+		t.Errorf("unknown mode should fail")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	var cases = []struct {
+		s, suffix string
+		max       int
+		want      string
+	}{
+		{s: "short", suffix: "...", max: 10, want: "short"},
+		{s: "exactly10!", suffix: "...", max: 10, want: "exactly10!"},
+		{s: "abcdefghijk", suffix: "...", max: 10, want: "abcdefg..."},
+		{s: "abcdeżółć", suffix: "...", max: 10, want: "abcdeż..."},
+		{s: "żółćżółć", suffix: "\n...", max: 9, want: "żó\n..."},
+		{s: "żółć", suffix: "...", max: 4, want: "..."},
+	}
+	for _, c := range cases {
+		got := truncate(c.s, c.max, c.suffix)
+		if got != c.want || len(got) > c.max || !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q, want %q", c.s, c.max, got, c.want)
+		}
+	}
+	text := strings.Repeat("ł", maxGitHubCheckText)
+	_, got := checkSummary(testFindings(1, text), false)
+	if len(got) > maxGitHubCheckText || !utf8.ValidString(got) {
+		t.Errorf("check text is not truncated on a rune boundary")
+	}
+}
+
+// githubRequest is a request received by testGitHubServer
+type githubRequest struct {
+	method string
+	path   string
+	auth   string
+	body   map[string]interface{}
+}
+
+// testGitHubServer is a local GitHub API stub, responses are taken from respond by "METHOD path",
+// default response is 200 with {"id":7}
+type testGitHubServer struct {
+	*httptest.Server
+	mtx      sync.Mutex
+	requests []*githubRequest
+	respond  map[string]func(w http.ResponseWriter)
+}
+
+// newTestGitHubServer starts GitHub API stub and points configuration to it, repo is "o/r"
+func newTestGitHubServer(t *testing.T) *testGitHubServer {
+	s := &testGitHubServer{respond: make(map[string]func(w http.ResponseWriter))}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := &githubRequest{method: req.Method, path: req.URL.RequestURI(), auth: req.Header.Get("Authorization")}
+		_ = json.NewDecoder(req.Body).Decode(&r.body)
+		s.mtx.Lock()
+		s.requests = append(s.requests, r)
+		respond := s.respond[req.Method+" "+req.URL.Path]
+		s.mtx.Unlock()
+		if respond != nil {
+			respond(w)
+			return
+		}
+		_, _ = io.WriteString(w, `{"id":7}`)
+	}))
+	saved := gCfg
+	t.Cleanup(func() {
+		s.Close()
+		gCfg = saved
+	})
+	cfg := *saved
+	cfg.GitHubAPIURL, cfg.GitHubRepo, cfg.GitHubStatusURL = s.URL+"/", "o/r", ""
+	gCfg = &cfg
+	return s
+}
+
+func TestGitHubClientCall(t *testing.T) {
+	s := newTestGitHubServer(t)
+	s.respond["GET /repos/o/r/pulls"] = func(w http.ResponseWriter) {
+		_, _ = io.WriteString(w, `[{"number":12,"html_url":"https://github.com/o/r/pull/12"}]`)
+	}
+	s.respond["PATCH /repos/o/r/pulls/12"] = func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = io.WriteString(w, `{"message":"Validation Failed"}`)
+	}
+	c := newGitHubClient(context.Background(), "tok")
+	pr, err := c.findPullRequest("gitdm-sync/db")
+	if err != nil || pr == nil || pr.Number != 12 {
+		t.Fatalf("got PR %+v, error %v", pr, err)
+	}
+	err = c.updatePullRequest(12, &githubPullRequestInput{State: "closed"})
+	if err == nil || !strings.Contains(err.Error(), "status 422") || !strings.Contains(err.Error(), "Validation Failed") {
+		t.Errorf("got error %v, want status 422 with response body", err)
+	}
+	want := []githubRequest{
+		{method: "GET", path: "/repos/o/r/pulls?state=open&head=o%3Agitdm-sync%2Fdb"},
+		{method: "PATCH", path: "/repos/o/r/pulls/12"},
+	}
+	if len(s.requests) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(s.requests), len(want))
+	}
+	for i, r := range s.requests {
+		if r.method != want[i].method || r.path != want[i].path || r.auth != "Bearer tok" {
+			t.Errorf("request %d: got %s %s (%s), want %s %s", i, r.method, r.path, r.auth, want[i].method, want[i].path)
+		}
+	}
+	if s.requests[1].body["state"] != "closed" {
+		t.Errorf("got payload %v", s.requests[1].body)
+	}
+}
+
+func TestReportCheckHTTP(t *testing.T) {
+	var cases = []struct {
+		name     string
+		mode     string
+		findings []*validationFinding
+		fail     string
+		paths    []string
+		anns     []int
+		err      bool
+	}{
+		{name: "status", mode: "status", findings: testFindings(2, "bad"), paths: []string{"POST /repos/o/r/statuses/abc"}},
+		{
+			name: "check with annotations batches", mode: "check", findings: testFindings(120, "bad"),
+			paths: []string{"POST /repos/o/r/check-runs", "PATCH /repos/o/r/check-runs/7", "PATCH /repos/o/r/check-runs/7"},
+			anns:  []int{50, 50, 20},
+		},
+		{name: "status rejected", mode: "status", fail: "POST /repos/o/r/statuses/abc", paths: []string{"POST /repos/o/r/statuses/abc"}, err: true},
+		{
+			name: "check rejected", mode: "check", findings: testFindings(120, "bad"), fail: "POST /repos/o/r/check-runs",
+			paths: []string{"POST /repos/o/r/check-runs"}, err: true,
+		},
+		{
+			name: "update rejected", mode: "check", findings: testFindings(120, "bad"), fail: "PATCH /repos/o/r/check-runs/7",
+			paths: []string{"POST /repos/o/r/check-runs", "PATCH /repos/o/r/check-runs/7"}, err: true,
+		},
+	}
+	for _, c := range cases {
+		s := newTestGitHubServer(t)
+		if c.fail != "" {
+			s.respond[c.fail] = func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = io.WriteString(w, `{"message":"Resource not accessible by integration"}`)
+			}
+		}
+		err := reportCheck(newGitHubClient(context.Background(), "tok"), c.mode, "abc", c.findings, false)
+		if (err != nil) != c.err || err != nil && !strings.Contains(err.Error(), "status 403") {
+			t.Errorf("%s: got error %v", c.name, err)
+		}
+		var paths []string
+		for _, r := range s.requests {
+			paths = append(paths, r.method+" "+r.path)
+			if r.auth != "Bearer tok" {
+				t.Errorf("%s: %s %s has authorization %q", c.name, r.method, r.path, r.auth)
+			}
+		}
+		if strings.Join(paths, ", ") != strings.Join(c.paths, ", ") {
+			t.Errorf("%s: got requests %v, want %v", c.name, paths, c.paths)
+			continue
+		}
+		if c.mode == "status" && !c.err {
+			body := s.requests[0].body
+			if body["state"] != "failure" || body["context"] != githubCheckName || !strings.HasPrefix(body["description"].(string), "2 validation error(s): ") {
+				t.Errorf("%s: got status %v", c.name, body)
+			}
+		}
+		for i, n := range c.anns {
+			output, _ := s.requests[i].body["output"].(map[string]interface{})
+			anns, _ := output["annotations"].([]interface{})
+			if len(anns) != n {
+				t.Errorf("%s: request %d has %d annotations, want %d", c.name, i, len(anns), n)
+			}
+		}
+		if len(c.anns) > 0 && (s.requests[0].body["head_sha"] != "abc" || s.requests[0].body["conclusion"] != "failure") {
+			t.Errorf("%s: got check run %v", c.name, s.requests[0].body)
+		}
+	}
+}
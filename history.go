@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// historyCacheDir is created in git directory, so the cache belongs to the clone and is never committed
+const historyCacheDir = "gitdm-sync-history"
+
+type revisionOutput struct {
+	SHA     string `yaml:"sha"`
+	Date    string `yaml:"date"`
+	Author  string `yaml:"author"`
+	Subject string `yaml:"subject"`
+}
+
+type profileAtOutput struct {
+	Commit   *revisionOutput `yaml:"commit"`
+	Profiles []*allOutput    `yaml:"profiles"`
+}
+
+// historyEntryOutput is a commit which changed matching profiles, full includes their state after the commit
+type historyEntryOutput struct {
+	SHA      string              `yaml:"sha"`
+	Date     string              `yaml:"date"`
+	Author   string              `yaml:"author"`
+	Subject  string              `yaml:"subject"`
+	Changes  *profilesDiffOutput `yaml:"changes"`
+	Profiles []*allOutput        `yaml:"profiles,omitempty"`
+}
+
+// historyCache returns profiles of past revisions, parsed state is cached in git directory by shard contents,
+// so commits which didn't touch profiles (or re-sharded them to the same files) share a single entry
+type historyCache struct {
+	dir   string
+	key   string
+	profs []*allOutput
+}
+
+func newHistoryCache(ctx context.Context) (*historyCache, bool) {
+	out, ok := execCommand(ctx, []string{"git", "rev-parse", "--absolute-git-dir"}, nil, 1, []int{})
+	if !ok {
+		return nil, false
+	}
+	return &historyCache{dir: filepath.Join(strings.TrimSpace(out), historyCacheDir)}, true
+}
+
+// revisionShards returns blob SHAs of profile shard files of a given commit, in shard order
+func revisionShards(ctx context.Context, sha string) ([]string, bool) {
+	out, ok := execCommand(ctx, []string{"git", "ls-tree", sha}, nil, 1, []int{})
+	if !ok {
+		return nil, false
+	}
+	blobs := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		ary := strings.SplitN(line, "\t", 2)
+		if len(ary) < 2 {
+			continue
+		}
+		fields := strings.Fields(ary[0])
+		if len(fields) == 3 && fields[1] == "blob" {
+			blobs[ary[1]] = fields[2]
+		}
+	}
+	var shards []string
+	for i := 1; ; i++ {
+		blob, ok := blobs[gCfg.profilesFile(i)]
+		if !ok {
+			break
+		}
+		shards = append(shards, blob)
+	}
+	return shards, true
+}
+
+// profilesAt returns all profiles as they were in a given commit
+func (h *historyCache) profilesAt(ctx context.Context, sha string) ([]*allOutput, bool) {
+	shards, ok := revisionShards(ctx, sha)
+	if !ok {
+		return nil, false
+	}
+	sum := sha1.Sum([]byte(strings.Join(shards, "\n")))
+	key := hex.EncodeToString(sum[:])
+	if key == h.key {
+		return h.profs, true
+	}
+	fn := filepath.Join(h.dir, key+".json.gz")
+	profs, found, err := readProfilesGz(fn)
+	if err != nil {
+		mWarnf(ctx, "ignoring broken history cache entry: %v\n", err)
+		found = false
+	}
+	if found {
+		now := time.Now()
+		_ = os.Chtimes(fn, now, now)
+	} else {
+		profs = nil
+		mPrintf(ctx, "parsing %d profile shards of %s\n", len(shards), sha)
+		parsed := make([][]*allOutput, len(shards))
+		err = runParallel(len(shards), gCfg.Workers, func(i int) error {
+			data, err := execCommandErr(ctx, []string{"git", "cat-file", "blob", shards[i]}, nil, 1, []int{})
+			if err != nil {
+				return err
+			}
+			parsed[i], err = decodeProfiles(strings.NewReader(data), sha+":"+gCfg.profilesFile(i+1))
+			return err
+		})
+		if fatalOnError(ctx, err, false) {
+			return nil, false
+		}
+		for _, shard := range parsed {
+			profs = append(profs, shard...)
+		}
+		// cache is only an optimization, the query works without it
+		if err = writeProfilesGz(fn, profs); err != nil {
+			mWarnf(ctx, "cannot cache profiles of %s: %v\n", sha, err)
+		}
+		pruneFiles(ctx, filepath.Join(h.dir, "*.json.gz"), gCfg.HistoryCacheKeep)
+	}
+	h.key, h.profs = key, profs
+	return profs, true
+}
+
+func parseRevision(line string) *revisionOutput {
+	ary := strings.SplitN(strings.TrimSpace(line), "\t", 4)
+	if len(ary) < 4 {
+		return nil
+	}
+	return &revisionOutput{SHA: ary[0], Date: ary[1], Author: ary[2], Subject: ary[3]}
+}
+
+// revisionLog runs git log with a given range arguments limited to the main line and returns commits, oldest first
+func revisionLog(ctx context.Context, args ...string) ([]*revisionOutput, bool) {
+	cmd := append([]string{"git", "log", "--first-parent", "--reverse", "--date=short", "--format=%H%x09%cd%x09%an%x09%s"}, args...)
+	out, ok := execCommand(ctx, cmd, nil, 1, []int{})
+	if !ok {
+		return nil, false
+	}
+	var revs []*revisionOutput
+	for _, line := range strings.Split(out, "\n") {
+		if rev := parseRevision(line); rev != nil {
+			revs = append(revs, rev)
+		}
+	}
+	return revs, true
+}
+
+// resolveRevision returns commit for a given commit-ish or the last commit of a given date (YYYY-MM-DD)
+func resolveRevision(ctx context.Context, rev string) (*revisionOutput, bool) {
+	var (
+		revs []*revisionOutput
+		ok   bool
+	)
+	if strings.HasPrefix(rev, "-") {
+		fatalf(ctx, false, "invalid revision '%s'", rev)
+		return nil, false
+	}
+	if validDate(rev) {
+		revs, ok = revisionLog(ctx, "-1", "--until="+rev+" 23:59:59", "HEAD")
+	} else {
+		revs, ok = revisionLog(ctx, "-1", "--no-walk", rev)
+	}
+	if !ok {
+		return nil, false
+	}
+	if len(revs) == 0 {
+		fatalf(ctx, false, "no commit found for '%s'", rev)
+		return nil, false
+	}
+	return revs[len(revs)-1], true
+}
+
+// profileAt returns profiles matching query (email, username or name) in a given commit or at the end of a given day
+func profileAt(ctx context.Context, query, rev string) (*profileAtOutput, bool) {
+	commit, ok := resolveRevision(ctx, rev)
+	if !ok {
+		return nil, false
+	}
+	h, ok := newHistoryCache(ctx)
+	if !ok {
+		return nil, false
+	}
+	profs, ok := h.profilesAt(ctx, commit.SHA)
+	if !ok {
+		return nil, false
+	}
+	return &profileAtOutput{Commit: commit, Profiles: findProfiles(profs, query)}, true
+}
+
+// profileHistory returns commits which changed profiles matching query, since and until are YYYY-MM-DD dates
+// (inclusive), changes are computed against state before the first listed commit
+func profileHistory(ctx context.Context, query, since, until string, full bool) ([]*historyEntryOutput, bool) {
+	for _, dt := range []string{since, until} {
+		if dt != "" && !validDate(dt) {
+			fatalf(ctx, false, "invalid date '%s', expected YYYY-MM-DD", dt)
+			return nil, false
+		}
+	}
+	args := []string{}
+	if since != "" {
+		args = append(args, "--since="+since+" 00:00:00")
+	}
+	if until != "" {
+		args = append(args, "--until="+until+" 23:59:59")
+	}
+	revs, ok := revisionLog(ctx, append(args, "HEAD", "--", gCfg.profilesGlob())...)
+	if !ok {
+		return nil, false
+	}
+	mPrintf(ctx, "%d commits changed profiles\n", len(revs))
+	h, ok := newHistoryCache(ctx)
+	if !ok {
+		return nil, false
+	}
+	var prev []*allOutput
+	if len(revs) > 0 {
+		// parent of the first commit is missing for the root commit
+		parent, ok := execCommand(ctx, []string{"git", "rev-parse", "--verify", "-q", revs[0].SHA + "^"}, nil, 1, []int{1})
+		if !ok {
+			return nil, false
+		}
+		if parent = strings.TrimSpace(parent); parent != "" {
+			profs, ok := h.profilesAt(ctx, parent)
+			if !ok {
+				return nil, false
+			}
+			prev = findProfiles(profs, query)
+		}
+	}
+	entries := []*historyEntryOutput{}
+	for _, rev := range revs {
+		profs, ok := h.profilesAt(ctx, rev.SHA)
+		if !ok {
+			return nil, false
+		}
+		curr := findProfiles(profs, query)
+		diff := diffProfiles(prev, curr)
+		prev = curr
+		if diff.size() == 0 {
+			continue
+		}
+		entry := &historyEntryOutput{SHA: rev.SHA, Date: rev.Date, Author: rev.Author, Subject: rev.Subject, Changes: diff}
+		if full {
+			entry.Profiles = curr
+		}
+		entries = append(entries, entry)
+	}
+	return entries, true
+}
+
+// historyCommand: gitdm-sync history email|username|name [since YYYY-MM-DD] [until YYYY-MM-DD] [full]
+// - shows commits of the local clone which changed matching profiles
+func historyCommand(ctx context.Context, args []string) bool {
+	usage := "usage: history email|username|name [since YYYY-MM-DD] [until YYYY-MM-DD] [full]"
+	if len(args) < 1 {
+		fatalf(ctx, false, "%s", usage)
+		return false
+	}
+	since, until, full := "", "", false
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "full" {
+			full = true
+			continue
+		}
+		if i+1 >= len(args) {
+			fatalf(ctx, false, "%s", usage)
+			return false
+		}
+		i++
+		switch arg {
+		case "since":
+			since = args[i]
+		case "until":
+			until = args[i]
+		default:
+			fatalf(ctx, false, "%s", usage)
+			return false
+		}
+	}
+	entries, ok := profileHistory(ctx, args[0], since, until, full)
+	if !ok {
+		return false
+	}
+	data, err := yaml.Marshal(entries)
+	if fatalOnError(ctx, err, false) {
+		return false
+	}
+	fmt.Printf("%s", data)
+	return true
+}
+
+// profileAtCommand: gitdm-sync profile-at email|username|name commit|YYYY-MM-DD
+// - shows matching profiles as they were in a given commit or at the end of a given day
+func profileAtCommand(ctx context.Context, args []string) bool {
+	if len(args) != 2 {
+		fatalf(ctx, false, "usage: profile-at email|username|name commit|YYYY-MM-DD")
+		return false
+	}
+	out, ok := profileAt(ctx, args[0], args[1])
+	if !ok {
+		return false
+	}
+	data, err := yaml.Marshal(out)
+	if fatalOnError(ctx, err, false) {
+		return false
+	}
+	fmt.Printf("%s", data)
+	return true
+}
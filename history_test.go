@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRevision is a commit made at noon UTC of date, commits without profiles only change README.md
+type testRevision struct {
+	date  string
+	profs []*allOutput
+}
+
+// testHistoryRepo makes the current directory a git repo with given commits and returns their SHAs
+func testHistoryRepo(t *testing.T, commits []testRevision) (shas []string) {
+	saved := gCfg
+	t.Cleanup(func() { gCfg = saved })
+	cfg := *saved
+	cfg.LogLevel = levelWarn
+	gCfg = &cfg
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("TZ", "UTC")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", "/dev/null")
+	testGit(t, dir, "init", "-q", "-b", "master")
+	for _, c := range commits {
+		if c.profs != nil {
+			removeCurrentYAMLs(context.Background())
+			if !writeProfiles(context.Background(), c.profs) {
+				t.Fatal("writing profiles failed")
+			}
+		} else if err := os.WriteFile("README.md", []byte(c.date), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("GIT_AUTHOR_DATE", c.date+"T12:00:00Z")
+		t.Setenv("GIT_COMMITTER_DATE", c.date+"T12:00:00Z")
+		testGit(t, dir, "add", ".")
+		testGit(t, dir, "commit", "-q", "-m", "commit "+c.date)
+		shas = append(shas, strings.TrimSpace(testGit(t, dir, "rev-parse", "HEAD")))
+	}
+	return
+}
+
+func TestProfileAt(t *testing.T) {
+	acme, other := testEnrollment("Acme", "1900-01-01", "2100-01-01", nil), testEnrollment("Other", "1900-01-01", "2100-01-01", nil)
+	jane := testProfile("Jane Roe", "jane@example.com", "")
+	shas := testHistoryRepo(t, []testRevision{
+		{date: "2021-03-01", profs: []*allOutput{testProfile("John Doe", "john@example.com", "jdoe", acme), jane}},
+		{date: "2021-06-01"},
+		{date: "2022-01-10", profs: []*allOutput{testProfile("John Doe", "john@example.com", "jdoe", other), jane}},
+	})
+	var cases = []struct {
+		query  string
+		rev    string
+		commit int
+		org    string
+		err    bool
+	}{
+		{query: "john!example.com", rev: "2021-02-28", err: true},
+		{query: "john!example.com", rev: "2021-03-01", commit: 0, org: "Acme"},
+		{query: "jdoe", rev: "2021-06-01", commit: 1, org: "Acme"},
+		{query: "John Doe", rev: "2022-01-09", commit: 1, org: "Acme"},
+		{query: "john!example.com", rev: "2022-01-10", commit: 2, org: "Other"},
+		{query: "john!example.com", rev: "2030-01-01", commit: 2, org: "Other"},
+		{query: "john!example.com", rev: shas[0], commit: 0, org: "Acme"},
+		{query: "john!example.com", rev: shas[2][:10], commit: 2, org: "Other"},
+		{query: "nobody!example.com", rev: "2022-01-10", commit: 2},
+		{query: "john!example.com", rev: "--all", err: true},
+		{query: "john!example.com", rev: "no-such-branch", err: true},
+	}
+	ctx := context.Background()
+	for _, c := range cases {
+		out, ok := profileAt(ctx, c.query, c.rev)
+		if ok == c.err {
+			t.Errorf("%s at %s: got ok %v", c.query, c.rev, ok)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		if out.Commit.SHA != shas[c.commit] {
+			t.Errorf("%s at %s: got commit %s (%s), want commit %d", c.query, c.rev, out.Commit.SHA, out.Commit.Date, c.commit+1)
+		}
+		var orgs []string
+		for _, prof := range out.Profiles {
+			for _, rol := range prof.Enrollments {
+				orgs = append(orgs, rol.Organization)
+			}
+		}
+		if strings.Join(orgs, ",") != c.org {
+			t.Errorf("%s at %s: got enrollments %v, want %s", c.query, c.rev, orgs, c.org)
+		}
+	}
+	cached, _ := filepath.Glob(filepath.Join(".git", historyCacheDir, "*.json.gz"))
+	if len(cached) != 2 {
+		t.Errorf("got %d cached states, want 2 (commits 1 and 2 share profile files)", len(cached))
+	}
+}
+
+func TestProfileHistory(t *testing.T) {
+	acme, other := testEnrollment("Acme", "1900-01-01", "2100-01-01", nil), testEnrollment("Other", "1900-01-01", "2100-01-01", nil)
+	jane := testProfile("Jane Roe", "jane@example.com", "")
+	shas := testHistoryRepo(t, []testRevision{
+		{date: "2021-03-01", profs: []*allOutput{testProfile("John Doe", "john@example.com", "jdoe", acme), jane}},
+		{date: "2021-06-01"},
+		{date: "2021-09-01", profs: []*allOutput{testProfile("John Doe", "john@example.com", "jdoe", acme)}},
+		{date: "2022-01-10", profs: []*allOutput{testProfile("John Doe", "john@example.com", "jdoe", other)}},
+	})
+	var cases = []struct {
+		query   string
+		since   string
+		until   string
+		commits []int
+		changes []string
+	}{
+		{query: "jdoe", commits: []int{0, 3}, changes: []string{"1 added, 0 removed, 0 changed", "0 added, 0 removed, 1 changed"}},
+		{query: "jdoe", since: "2021-06-01", commits: []int{3}, changes: []string{"0 added, 0 removed, 1 changed"}},
+		{query: "jdoe", until: "2021-12-31", commits: []int{0}, changes: []string{"1 added, 0 removed, 0 changed"}},
+		{query: "Jane Roe", commits: []int{0, 2}, changes: []string{"1 added, 0 removed, 0 changed", "0 added, 1 removed, 0 changed"}},
+		{query: "jdoe", since: "2022-02-01"},
+	}
+	ctx := context.Background()
+	for _, c := range cases {
+		entries, ok := profileHistory(ctx, c.query, c.since, c.until, false)
+		if !ok {
+			t.Errorf("%s since %q until %q: failed", c.query, c.since, c.until)
+			continue
+		}
+		var got, want []string
+		for _, entry := range entries {
+			got = append(got, entry.SHA[:7]+" "+entry.Changes.String())
+		}
+		for i, n := range c.commits {
+			want = append(want, shas[n][:7]+" "+c.changes[i])
+		}
+		if strings.Join(got, "; ") != strings.Join(want, "; ") {
+			t.Errorf("%s since %q until %q: got %v, want %v", c.query, c.since, c.until, got, want)
+		}
+	}
+	if _, ok := profileHistory(ctx, "jdoe", "2021-13-01", "", false); ok {
+		t.Errorf("invalid date accepted")
+	}
+}
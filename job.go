@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// job phases, each phase has its own deadline
+const (
+	phaseQueue    = "queue"
+	phaseClone    = "clone"
+	phaseParse    = "parse"
+	phaseValidate = "validate"
+	phaseSort     = "sort"
+	phaseWrite    = "write"
+	phasePush     = "push"
+	phaseAPI      = "api"
+)
+
+// jobPhases are phases a single job can go through, in order
+var jobPhases = []string{phaseClone, phaseParse, phaseValidate, phaseSort, phaseWrite, phasePush, phaseAPI}
+
+// job is a single request processed while holding gMtx, its context is cancelled when client disconnects
+// (except for GitHub webhooks, which time out after 10s but the job should still finish); job's context carries
+// the job, so everything called with it logs job fields and reports errors to the job's client (w)
+type job struct {
+	ID      string
+	Kind    string
+	Started time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	locked time.Time
+
+	mtx         sync.Mutex
+	w           http.ResponseWriter
+	Caller      string
+	PR          int64
+	outcome     string
+	phase       string
+	phaseStart  time.Time
+	phaseCtx    context.Context
+	phaseCancel context.CancelFunc
+	pushed      string
+}
+
+// gJob is the job currently holding gMtx, nil when idle or when running CLI commands; it is only used to report
+// and to cancel the job, job's own code gets it from its context
+var (
+	gJob    *job
+	gJobMtx sync.Mutex
+)
+
+type jobKey struct{}
+
+// ctxJob returns job a given context belongs to, nil for CLI commands and requests which are not jobs
+func ctxJob(ctx context.Context) *job {
+	j, _ := ctx.Value(jobKey{}).(*job)
+	return j
+}
+
+// ctxRequestID returns ID of the job or request a given context belongs to, empty for CLI commands
+func ctxRequestID(ctx context.Context) string {
+	if j := ctxJob(ctx); j != nil {
+		return j.ID
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// phaseTimeout returns deadline of a given phase
+func (c *config) phaseTimeout(phase string) time.Duration {
+	switch phase {
+	case phaseClone:
+		return c.CloneTimeout
+	case phaseParse:
+		return c.ParseTimeout
+	case phaseValidate:
+		return c.ValidateTimeout
+	case phaseSort, phaseWrite:
+		return c.WriteFilesTimeout
+	case phasePush:
+		return c.PushTimeout
+	case phaseAPI:
+		return c.APITimeout
+	}
+	return c.CommandTimeout
+}
+
+// jobTimeout returns the longest time a job can take after leaving the queue
+func (c *config) jobTimeout() (d time.Duration) {
+	for _, phase := range jobPhases {
+		d += c.phaseTimeout(phase)
+	}
+	return
+}
+
+// beginJob waits for gMtx and makes a new job current, caller must call endJob
+func beginJob(w http.ResponseWriter, req *http.Request, kind string) (*job, bool) {
+	parent := req.Context()
+	if req.Header.Get("X-GitHub-Event") != "" {
+		parent = context.Background()
+	}
+	return startJob(parent, w, requestID(req), kind)
+}
+
+// startJob is beginJob for a given parent context, w is nil for jobs started by the service itself
+func startJob(parent context.Context, w http.ResponseWriter, id, kind string) (*job, bool) {
+	if id == "" {
+		id = newJobID()
+	}
+	j := &job{ID: id, Kind: kind, Started: time.Now(), w: w, phase: phaseQueue, phaseStart: time.Now()}
+	j.ctx, j.cancel = context.WithCancel(context.WithValue(parent, jobKey{}, j))
+	ctx := j.ctx
+	logf(j.fields(), levelInfo, "waiting for previous job to finish\n")
+	gStatus.enqueue(1)
+	gMtx.Lock()
+	gStatus.enqueue(-1)
+	j.locked = time.Now()
+	observeDuration(gMetrics.queueWait, j.Started)
+	gJobMtx.Lock()
+	gJob = j
+	gJobMtx.Unlock()
+	mPrintf(ctx, "job started, waited %v\n", time.Since(j.Started))
+	if rejectShutdown(w) {
+		j.outcome = outcomeAborted
+		mWarnf(ctx, "job rejected, service is shutting down\n")
+		return j, false
+	}
+	if ctx.Err() != nil {
+		j.outcome = outcomeCancelled
+		fatalf(ctx, false, "job %s cancelled in phase '%s' (client disconnected)", j.ID, phaseQueue)
+		return j, false
+	}
+	return j, true
+}
+
+// endJob releases gMtx and records job metrics, errors reported later with job's context are only logged
+func endJob(j *job) {
+	j.mtx.Lock()
+	j.w = nil
+	if j.phaseCancel != nil {
+		j.phaseCancel()
+	}
+	j.observePhase()
+	if j.outcome == "" {
+		j.outcome = outcomeSuccess
+	}
+	outcome := j.outcome
+	j.mtx.Unlock()
+	j.cancel()
+	gMetrics.jobs.WithLabelValues(j.Kind, outcome).Inc()
+	observeDuration(gMetrics.jobDuration.WithLabelValues(j.Kind), j.locked)
+	mPrintf(j.ctx, "job finished in %v: %s\n", time.Since(j.Started), outcome)
+	gJobMtx.Lock()
+	gJob = nil
+	gJobMtx.Unlock()
+	gMtx.Unlock()
+}
+
+func currentJob() *job {
+	gJobMtx.Lock()
+	defer gJobMtx.Unlock()
+	return gJob
+}
+
+// setPhase starts a new phase with its own deadline, it fails when the previous phase ran out of time
+// (CPU bound work cannot be interrupted, so it is checked at phase boundaries) or when job was cancelled;
+// during shutdown it also fails unless the job already pushed a commit, such job finishes within the grace period
+// so the pushed commit is synced to DB
+func (j *job) setPhase(phase string) bool {
+	var err error
+	j.mtx.Lock()
+	if j.phaseCtx != nil && j.phaseCtx.Err() != nil {
+		err = j.failure(j.phaseCtx.Err())
+	} else if shuttingDown() && j.pushed == "" {
+		// phase boundary is a safe checkpoint: previous phase is complete and the next one has not started
+		j.outcome = outcomeAborted
+		err = fmt.Errorf("job %s aborted after phase '%s': service is shutting down", j.ID, j.phase)
+	} else {
+		if j.phaseCancel != nil {
+			j.phaseCancel()
+		}
+		j.observePhase()
+		j.phase = phase
+		j.phaseStart = time.Now()
+		j.phaseCtx, j.phaseCancel = context.WithTimeout(j.ctx, gCfg.phaseTimeout(phase))
+	}
+	pushed := j.pushed
+	j.mtx.Unlock()
+	if fatalOnError(j.ctx, err, false) {
+		return false
+	}
+	if pushed != "" && shuttingDown() {
+		mPrintf(j.ctx, "service is shutting down, continuing because commit %s was already pushed\n", pushed)
+	}
+	mPrintf(j.ctx, "phase started, deadline %v\n", gCfg.phaseTimeout(phase))
+	return true
+}
+
+// fields returns job log fields
+func (j *job) fields() logFields {
+	fields := logFields{"request_id": j.ID, "kind": j.Kind}
+	j.mtx.Lock()
+	if j.Caller != "" {
+		fields["caller"] = j.Caller
+	}
+	if j.PR > 0 {
+		fields["pr"] = j.PR
+	}
+	fields["phase"] = j.phase
+	j.mtx.Unlock()
+	return fields
+}
+
+// setCaller and setPR are used because job fields are also read by /status
+func (j *job) setCaller(caller string) {
+	j.mtx.Lock()
+	j.Caller = caller
+	j.mtx.Unlock()
+}
+
+func (j *job) setPR(pr int64) {
+	j.mtx.Lock()
+	j.PR = pr
+	j.mtx.Unlock()
+}
+
+// observePhase records duration of the current phase, j.mtx must be held
+func (j *job) observePhase() {
+	if j.phase != phaseQueue {
+		observeDuration(gMetrics.phaseDuration.WithLabelValues(j.phase), j.phaseStart)
+	}
+}
+
+// failed marks job as failed unless it already failed because of timeout or cancellation,
+// error message is returned to the job's client while the job is running
+func (j *job) failed(msg string) {
+	j.mtx.Lock()
+	if j.outcome == "" {
+		j.outcome = outcomeError
+	}
+	w := j.w
+	j.mtx.Unlock()
+	if w != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, timeStampStr()+msg+"\n")
+	}
+}
+
+// result returns job outcome, it is final once endJob returned
+func (j *job) result() string {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.outcome
+}
+
+// failure describes err caused by job cancellation or by current phase deadline, j.mtx must be held
+func (j *job) failure(err error) error {
+	switch {
+	case j.ctx.Err() == context.Canceled && shuttingDown() && j.pushed != "":
+		j.outcome = outcomeCancelled
+		return fmt.Errorf("job %s cancelled in phase '%s' (shutdown grace period expired), pushed commit %s is synced by the next push: %v", j.ID, j.phase, j.pushed, err)
+	case j.ctx.Err() == context.Canceled && shuttingDown():
+		j.outcome = outcomeCancelled
+		return fmt.Errorf("job %s cancelled in phase '%s' (shutdown grace period expired): %v", j.ID, j.phase, err)
+	case j.ctx.Err() == context.Canceled:
+		j.outcome = outcomeCancelled
+		return fmt.Errorf("job %s cancelled in phase '%s' (client disconnected): %v", j.ID, j.phase, err)
+	case j.phaseCtx != nil && j.phaseCtx.Err() == context.DeadlineExceeded:
+		j.outcome = outcomeTimeout
+		return fmt.Errorf("job %s timed out in phase '%s' after %v: %v", j.ID, j.phase, gCfg.phaseTimeout(j.phase), err)
+	}
+	return err
+}
+
+// jobPhase sets phase of the job of ctx, it does nothing for CLI commands
+func jobPhase(ctx context.Context, phase string) bool {
+	j := ctxJob(ctx)
+	if j == nil {
+		return true
+	}
+	return j.setPhase(phase)
+}
+
+// jobPushed records that the job of ctx pushed sha, so shutdown no longer stops it at phase boundaries
+func jobPushed(ctx context.Context, sha string) {
+	j := ctxJob(ctx)
+	if j == nil {
+		return
+	}
+	j.mtx.Lock()
+	j.pushed = sha
+	j.mtx.Unlock()
+}
+
+// jobContext returns context of the current phase of the job of ctx, ctx itself for CLI commands
+func jobContext(ctx context.Context) context.Context {
+	j := ctxJob(ctx)
+	if j == nil {
+		return ctx
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if j.phaseCtx == nil {
+		return j.ctx
+	}
+	return j.phaseCtx
+}
+
+// jobError adds job phase and reason to errors caused by cancellation or deadline
+func jobError(ctx context.Context, err error) error {
+	j := ctxJob(ctx)
+	if j == nil || err == nil {
+		return err
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.failure(err)
+}
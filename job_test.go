@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSetPhaseShutdown(t *testing.T) {
+	saved := gMtx
+	defer func() { gMtx = saved; atomic.StoreInt32(&gShutdown, 0) }()
+	gMtx = &sync.Mutex{}
+	var cases = []struct {
+		name     string
+		pushed   bool
+		shutdown bool
+		ok       bool
+		outcome  string
+	}{
+		{name: "running", ok: true},
+		{name: "running after push", pushed: true, ok: true},
+		{name: "shutdown before push", shutdown: true, outcome: outcomeAborted},
+		{name: "shutdown after push", pushed: true, shutdown: true, ok: true},
+	}
+	for _, c := range cases {
+		atomic.StoreInt32(&gShutdown, 0)
+		j, ok := startJob(context.Background(), httptest.NewRecorder(), "", "push")
+		if !ok {
+			t.Fatalf("%s: job not started", c.name)
+		}
+		ctx := j.ctx
+		if !jobPhase(ctx, phasePush) {
+			t.Fatalf("%s: push phase not started", c.name)
+		}
+		if c.pushed {
+			jobPushed(ctx, "abc")
+		}
+		if c.shutdown {
+			atomic.StoreInt32(&gShutdown, 1)
+		}
+		if got := jobPhase(ctx, phaseAPI); got != c.ok {
+			t.Errorf("%s: api phase started = %v, want %v", c.name, got, c.ok)
+		}
+		if got := j.result(); got != c.outcome {
+			t.Errorf("%s: got outcome %q, want %q", c.name, got, c.outcome)
+		}
+		endJob(j)
+	}
+}
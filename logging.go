@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// log levels
+const (
+	levelDebug = "debug"
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+)
+
+var logLevels = map[string]int{levelDebug: 0, levelInfo: 1, levelWarn: 2, levelError: 3}
+
+// logFields are added to a log line, job fields are: request_id, kind, caller, pr, phase
+type logFields map[string]interface{}
+
+type requestIDKey struct{}
+
+var gLogMtx sync.Mutex
+
+// logf writes a single log line: JSON object with time, level, msg and fields, or "time: [level] [fields] msg" text
+// used by CLI commands; in text format warnings and errors go to stderr
+func logf(fields logFields, level, format string, args ...interface{}) {
+	if logLevels[level] < logLevels[gCfg.LogLevel] {
+		return
+	}
+	now := time.Now()
+	msg := redact(strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+	var line []byte
+	out := io.Writer(os.Stdout)
+	if gCfg.LogFormat == "json" {
+		entry := map[string]interface{}{"time": now.Format(time.RFC3339Nano), "level": level, "msg": msg}
+		for k, v := range fields {
+			if s, ok := v.(string); ok {
+				v = redact(s)
+			}
+			entry[k] = v
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			data = []byte(fmt.Sprintf(`{"time":"%s","level":"error","msg":"cannot marshal log entry: %s"}`, now.Format(time.RFC3339Nano), jsonEscape(err.Error())))
+		}
+		line = append(data, '\n')
+	} else {
+		prefix := now.Format(dateTimeFormatMillis) + ": "
+		if level != levelInfo {
+			prefix += "[" + level + "] "
+		}
+		keys := []string{}
+		for k := range fields {
+			if k != "stack" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		if len(keys) > 0 {
+			kv := []string{}
+			for _, k := range keys {
+				kv = append(kv, fmt.Sprintf("%s=%v", k, fields[k]))
+			}
+			prefix += "[" + redact(strings.Join(kv, " ")) + "] "
+		}
+		line = []byte(prefix + msg + "\n")
+		if stack, ok := fields["stack"]; ok {
+			line = append(line, []byte(fmt.Sprintf("%v\n", stack))...)
+		}
+		if logLevels[level] >= logLevels[levelWarn] {
+			out = os.Stderr
+		}
+	}
+	gLogMtx.Lock()
+	_, _ = out.Write(line)
+	gLogMtx.Unlock()
+}
+
+// ctxFields returns fields of the job or request a given context belongs to, nil when there is none
+func ctxFields(ctx context.Context) logFields {
+	if j := ctxJob(ctx); j != nil {
+		return j.fields()
+	}
+	if id, _ := ctx.Value(requestIDKey{}).(string); id != "" {
+		return logFields{"request_id": id}
+	}
+	return nil
+}
+
+func mPrintf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctxFields(ctx), levelInfo, format, args...)
+}
+
+func mDebugf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctxFields(ctx), levelDebug, format, args...)
+}
+
+func mWarnf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctxFields(ctx), levelWarn, format, args...)
+}
+
+// reqPrintf logs a line about request which may be not the current job (waiting for it or already finished)
+func reqPrintf(req *http.Request, format string, args ...interface{}) {
+	logf(logFields{"request_id": requestID(req)}, levelInfo, format, args...)
+}
+
+// logStack logs error with stack trace, used only before panic
+func logStack(ctx context.Context, msg string) {
+	fields := ctxFields(ctx)
+	if fields == nil {
+		fields = logFields{}
+	}
+	fields["stack"] = string(debug.Stack())
+	logf(fields, levelError, "%s", msg)
+}
+
+// withRequestID assigns new request ID to request, it is also returned in X-Request-ID header and used as job ID
+func withRequestID(w http.ResponseWriter, req *http.Request) *http.Request {
+	id := newJobID()
+	w.Header().Set("X-Request-ID", id)
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id))
+}
+
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// job outcomes
+const (
+	outcomeSuccess   = "success"
+	outcomeError     = "error"
+	outcomeTimeout   = "timeout"
+	outcomeCancelled = "cancelled"
+	outcomeAborted   = "aborted"
+)
+
+// durationBuckets cover 100ms - ~27m
+var durationBuckets = prometheus.ExponentialBuckets(0.1, 2, 15)
+
+// gMetrics are exposed on /metrics
+var gMetrics = struct {
+	jobs                *prometheus.CounterVec
+	jobDuration         *prometheus.HistogramVec
+	phaseDuration       *prometheus.HistogramVec
+	queueWait           prometheus.Histogram
+	profilesRead        *prometheus.CounterVec
+	shardsWritten       prometheus.Counter
+	dbChanges           *prometheus.HistogramVec
+	tokenRefreshes      *prometheus.CounterVec
+	unauthorizedRetries *prometheus.CounterVec
+	driftProfiles       *prometheus.GaugeVec
+	driftDuration       prometheus.Gauge
+	driftChecked        prometheus.Gauge
+}{
+	jobs: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gitdm_sync_jobs_total",
+		Help: "Finished jobs by type and outcome (success, error, timeout, cancelled, aborted).",
+	}, []string{"kind", "outcome"}),
+	jobDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gitdm_sync_job_duration_seconds",
+		Help:    "Job duration by type, excluding queue wait.",
+		Buckets: durationBuckets,
+	}, []string{"kind"}),
+	phaseDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gitdm_sync_phase_duration_seconds",
+		Help:    "Job phase duration (clone, parse, validate, sort, write, push, api).",
+		Buckets: durationBuckets,
+	}, []string{"phase"}),
+	queueWait: promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gitdm_sync_queue_wait_seconds",
+		Help:    "Time jobs wait for the previous job to finish.",
+		Buckets: durationBuckets,
+	}),
+	profilesRead: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gitdm_sync_profiles_read_total",
+		Help: "Profiles read from YAML files and from DB.",
+	}, []string{"source"}),
+	shardsWritten: promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gitdm_sync_shards_written_total",
+		Help: "Profile YAML files written.",
+	}),
+	dbChanges: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gitdm_sync_db_changes",
+		Help:    "Profiles added to and deleted from DB per sync.",
+		Buckets: []float64{0, 1, 5, 10, 50, 100, 500, 1000, 5000},
+	}, []string{"op"}),
+	tokenRefreshes: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gitdm_sync_auth0_token_refreshes_total",
+		Help: "Auth0 token requests by outcome.",
+	}, []string{"outcome"}),
+	unauthorizedRetries: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gitdm_sync_api_unauthorized_retries_total",
+		Help: "DB API calls retried with a new token after 401 response.",
+	}, []string{"call"}),
+	driftProfiles: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gitdm_sync_drift_profiles",
+		Help: "Profiles only in repo (added), only in DB (removed) and different (changed) at the last drift check.",
+	}, []string{"kind"}),
+	driftDuration: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gitdm_sync_drift_duration_seconds",
+		Help: "How long repo and DB have been different as of the last drift check, 0 when they match.",
+	}),
+	driftChecked: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gitdm_sync_drift_last_check_timestamp_seconds",
+		Help: "Unix time of the last successful drift check.",
+	}),
+}
+
+func observeDuration(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
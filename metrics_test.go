@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricsRegistered(t *testing.T) {
+	var cases = []struct {
+		name      string
+		collector prometheus.Collector
+	}{
+		{name: "gitdm_sync_jobs_total", collector: gMetrics.jobs},
+		{name: "gitdm_sync_job_duration_seconds", collector: gMetrics.jobDuration},
+		{name: "gitdm_sync_phase_duration_seconds", collector: gMetrics.phaseDuration},
+		{name: "gitdm_sync_queue_wait_seconds", collector: gMetrics.queueWait},
+		{name: "gitdm_sync_profiles_read_total", collector: gMetrics.profilesRead},
+		{name: "gitdm_sync_shards_written_total", collector: gMetrics.shardsWritten},
+		{name: "gitdm_sync_db_changes", collector: gMetrics.dbChanges},
+		{name: "gitdm_sync_auth0_token_refreshes_total", collector: gMetrics.tokenRefreshes},
+		{name: "gitdm_sync_api_unauthorized_retries_total", collector: gMetrics.unauthorizedRetries},
+		{name: "gitdm_sync_drift_profiles", collector: gMetrics.driftProfiles},
+		{name: "gitdm_sync_drift_duration_seconds", collector: gMetrics.driftDuration},
+		{name: "gitdm_sync_drift_last_check_timestamp_seconds", collector: gMetrics.driftChecked},
+	}
+	for _, c := range cases {
+		err := prometheus.Register(c.collector)
+		var already prometheus.AlreadyRegisteredError
+		if !errors.As(err, &already) {
+			t.Errorf("%s: not registered in default registry: %v", c.name, err)
+		}
+		ch := make(chan *prometheus.Desc, 1)
+		c.collector.Describe(ch)
+		if desc := (<-ch).String(); !strings.Contains(desc, `fqName: "`+c.name+`"`) {
+			t.Errorf("%s: got %s", c.name, desc)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	savedMtx, savedCfg := gMtx, gCfg
+	defer func() { gMtx, gCfg = savedMtx, savedCfg }()
+	gMtx = &sync.Mutex{}
+	cfg := *savedCfg
+	cfg.APIToken = "tok12345"
+	gCfg = &cfg
+	j, ok := startJob(context.Background(), nil, "", "metrics-test")
+	if !ok || !jobPhase(j.ctx, phaseParse) {
+		t.Fatal("job not started")
+	}
+	endJob(j)
+	handler := authorized(promhttp.Handler().ServeHTTP)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 401 {
+		t.Errorf("got status %d without token, want 401", w.Code)
+	}
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer tok12345")
+	handler(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, want := range []string{
+		`gitdm_sync_jobs_total{kind="metrics-test",outcome="success"} 1`,
+		`gitdm_sync_job_duration_seconds_count{kind="metrics-test"} 1`,
+		`gitdm_sync_phase_duration_seconds_count{phase="parse"}`,
+		`gitdm_sync_queue_wait_seconds_count`,
+		`# TYPE gitdm_sync_shards_written_total counter`,
+		`# TYPE gitdm_sync_drift_duration_seconds gauge`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("got status %d, /metrics has no %s", w.Code, want)
+		}
+	}
+}
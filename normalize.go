@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// letters that have no canonical decomposition, so stripping combining marks doesn't convert them to ASCII
+var transliterations = map[rune]string{
+	'ł': "l", 'ø': "o", 'đ': "d", 'ð': "d", 'ħ': "h", 'ı': "i", 'ŀ': "l", 'ŧ': "t",
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'þ': "th", 'ŋ': "n", 'ĸ': "k",
+}
+
+// normalizeName returns NFC normalized, case folded name with collapsed whitespace,
+// when translit is set diacritics are removed and special letters are transliterated: "Łukasz" -> "lukasz"
+func normalizeName(name string, translit bool) string {
+	name = cases.Fold().String(norm.NFC.String(name))
+	if translit {
+		t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+		stripped, _, err := transform.String(t, name)
+		if err == nil {
+			name = stripped
+		}
+		var b strings.Builder
+		for _, r := range name {
+			tr, ok := transliterations[r]
+			if ok {
+				b.WriteString(tr)
+				continue
+			}
+			b.WriteRune(r)
+		}
+		name = b.String()
+	}
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// orderKey is used to order profiles in files: normalized name first, so case and diacritic variants are
+// next to each other, full sort key as a tie breaker keeps the order deterministic; it never depends on config,
+// otherwise services configured differently would keep reordering each other's files
+func (a *allOutput) orderKey() string {
+	name := ""
+	if a.Name != nil {
+		name = normalizeName(*a.Name, true)
+	}
+	return name + "\x00" + a.sortKey()
+}
+
+// normalizeProfileOrder sorts profile's enrollments and identities, so they are written in a deterministic order
+func normalizeProfileOrder(prof *allOutput) {
+	if len(prof.Enrollments) > 1 {
+		sort.SliceStable(prof.Enrollments, func(i, j int) bool {
+			return prof.Enrollments[i].sortKey() < prof.Enrollments[j].sortKey()
+		})
+	}
+	if len(prof.Identities) > 1 {
+		sort.SliceStable(prof.Identities, func(i, j int) bool {
+			return prof.Identities[i].sortKey() < prof.Identities[j].sortKey()
+		})
+	}
+}
+
+// sortProfiles sorts profiles by order key, keys are computed once per profile
+func sortProfiles(profs []*allOutput) {
+	keys := make(map[*allOutput]string, len(profs))
+	for _, prof := range profs {
+		keys[prof] = prof.orderKey()
+	}
+	sort.SliceStable(profs, func(i, j int) bool {
+		return keys[profs[i]] < keys[profs[j]]
+	})
+}
+
+// reshardCommand: gitdm-sync reshard - one time migration that rewrites all profile files using normalized names order,
+// profiles are streamed through an external sort, so at most sort_run_size of them are held in memory
+func reshardCommand(ctx context.Context, args []string) bool {
+	sorter := newProfileSorter(ctx, gCfg.SortRunSize)
+	defer sorter.close()
+	n := 0
+	err := readProfileShards(ctx, func(prof *allOutput, loc profileLocation) error {
+		n++
+		return sorter.add(prof)
+	})
+	if fatalOnError(ctx, err, false) {
+		return false
+	}
+	removeCurrentYAMLs(ctx)
+	if !writeSortedProfiles(ctx, sorter) {
+		return false
+	}
+	mPrintf(ctx, "%d profiles resharded\n", n)
+	return true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	var cases = []struct {
+		name     string
+		translit string
+		plain    string
+	}{
+		{name: "Łukasz  Gryglicki", translit: "lukasz gryglicki", plain: "łukasz gryglicki"},
+		{name: "José", translit: "jose", plain: "josé"},
+		{name: "Jose\u0301", translit: "jose", plain: "josé"},
+		{name: "Straße", translit: "strasse", plain: "strasse"},
+		{name: "Søren Æbelø", translit: "soren aebelo", plain: "søren æbelø"},
+		{name: " JO\tDOE ", translit: "jo doe", plain: "jo doe"},
+	}
+	for _, c := range cases {
+		if got := normalizeName(c.name, true); got != c.translit {
+			t.Errorf("normalizeName(%q, true) = %q, want %q", c.name, got, c.translit)
+		}
+		if got := normalizeName(c.name, false); got != c.plain {
+			t.Errorf("normalizeName(%q, false) = %q, want %q", c.name, got, c.plain)
+		}
+	}
+}
+
+func TestOrderKeyIgnoresConfig(t *testing.T) {
+	saved := gCfg.Transliterate
+	defer func() { gCfg.Transliterate = saved }()
+	profs := []*allOutput{testProfile("Łukasz", "", ""), testProfile("lukasz", "a@b.c", ""), testProfile("Zoe", "", ""), testProfile("Lara", "", "")}
+	var keys [2][]string
+	for i, translit := range []bool{true, false} {
+		gCfg.Transliterate = translit
+		for _, prof := range profs {
+			keys[i] = append(keys[i], prof.orderKey())
+		}
+	}
+	for i := range profs {
+		if keys[0][i] != keys[1][i] {
+			t.Errorf("order key of %s depends on transliterate: %q != %q", profs[i].label(), keys[0][i], keys[1][i])
+		}
+	}
+	sortProfiles(profs)
+	var names []string
+	for _, prof := range profs {
+		names = append(names, *prof.Name)
+	}
+	// "lukasz" and "Łukasz" have the same normalized name, they are ordered by their sort keys
+	if len(names) != 4 || names[0] != "Lara" || names[3] != "Zoe" {
+		t.Errorf("sortProfiles = %v, want Lara, both Łukasz variants, Zoe", names)
+	}
+}
+
+func TestMatchNameTransliterate(t *testing.T) {
+	saved := gCfg.Transliterate
+	defer func() { gCfg.Transliterate = saved }()
+	var cases = []struct {
+		translit bool
+		a, b     string
+		match    bool
+	}{
+		{translit: true, a: "Łukasz Gryglicki", b: "lukasz gryglicki", match: true},
+		{translit: false, a: "Łukasz Gryglicki", b: "lukasz gryglicki", match: false},
+		{translit: false, a: "Jo-Ann DOE", b: "jo ann doe", match: true},
+	}
+	for _, c := range cases {
+		gCfg.Transliterate = c.translit
+		if got := matchName(c.a) == matchName(c.b); got != c.match {
+			t.Errorf("transliterate %v: %q matches %q = %v, want %v", c.translit, c.a, c.b, got, c.match)
+		}
+	}
+}
+
+func TestReshard(t *testing.T) {
+	withWorkers(2, func() {
+		gCfg.ShardSize, gCfg.SortRunSize = 32<<10, 300
+		profs := testProfiles(2000, 5)
+		for _, prof := range profs {
+			normalizeProfileOrder(prof)
+		}
+		// unsorted files are resharded the same way push sync writes them
+		t.Chdir(t.TempDir())
+		w := newShardWriter(context.Background())
+		for _, prof := range profs {
+			if err := w.write(prof); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+		if !reshardCommand(context.Background(), nil) {
+			t.Fatal("reshard failed")
+		}
+		resharded := readShardFiles(t)
+		t.Chdir(t.TempDir())
+		if !writeProfiles(context.Background(), profs) {
+			t.Fatal("writing profiles failed")
+		}
+		written := readShardFiles(t)
+		if len(written) < 2 || strings.Join(written, "") != strings.Join(resharded, "") {
+			t.Fatalf("resharded files differ from files written by push sync")
+		}
+		// already sorted files are not changed
+		if !reshardCommand(context.Background(), nil) {
+			t.Fatal("reshard failed")
+		}
+		if again := readShardFiles(t); len(again) != len(written) || strings.Join(again, "") != strings.Join(written, "") {
+			t.Errorf("resharding sorted files changed them")
+		}
+	})
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const organizationsFile = "organizations.yaml"
+
+type organizationOutput struct {
+	Name    string   `yaml:"C"`
+	Aliases []string `yaml:"A,omitempty"`
+	Domains []string `yaml:"D,omitempty"`
+	Parent  *string  `yaml:"P,omitempty"`
+	Start   string   `yaml:"F,omitempty"`
+	End     string   `yaml:"T,omitempty"`
+}
+
+type organizationsOutput struct {
+	Organizations []*organizationOutput `yaml:"O,omitempty"`
+}
+
+type organizations struct {
+	present bool
+	byName  map[string]*organizationOutput
+	aliases map[string]string
+	names   []string
+	similar map[string]string
+}
+
+func (o *organizationOutput) start() string {
+	if o.Start == "" {
+		return minEnrollDate
+	}
+	return o.Start
+}
+
+func (o *organizationOutput) end() string {
+	if o.End == "" {
+		return maxEnrollDate
+	}
+	return o.End
+}
+
+// readOrganizations reads organizations file, ok is false when it cannot be read, malformed file is returned
+// in parseErr, so it can be reported as a validation finding
+func readOrganizations(ctx context.Context) (orgs *organizationsOutput, present, ok bool, parseErr error) {
+	orgs = &organizationsOutput{}
+	data, err := ioutil.ReadFile(organizationsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			mPrintf(ctx, "no %s file, organizations are not validated\n", organizationsFile)
+			ok = true
+			return
+		}
+		fatalOnError(ctx, err, false)
+		return
+	}
+	mPrintf(ctx, "parse %s\n", organizationsFile)
+	err = yaml.Unmarshal(data, orgs)
+	if err != nil {
+		orgs = &organizationsOutput{}
+		parseErr = errors.Wrap(err, organizationsFile)
+	}
+	present = true
+	ok = true
+	return
+}
+
+func (d *organizationsOutput) validate() (errs []string) {
+	names := make(map[string]struct{})
+	parents := make(map[string]string)
+	for _, org := range d.Organizations {
+		names[org.Name] = struct{}{}
+		// self-parenting is reported on its own, not as a cycle
+		if org.Parent != nil && *org.Parent != org.Name {
+			parents[org.Name] = *org.Parent
+		}
+	}
+	seen := make(map[string]string)
+	for i, org := range d.Organizations {
+		if strings.TrimSpace(org.Name) == "" {
+			errs = append(errs, fmt.Sprintf("organization #%d: invalid name '%s'", i+1, org.Name))
+			continue
+		}
+		for _, name := range append([]string{org.Name}, org.Aliases...) {
+			key := strings.ToLower(name)
+			prev, dup := seen[key]
+			if dup {
+				errs = append(errs, fmt.Sprintf("organization '%s': name or alias '%s' already used by '%s'", org.Name, name, prev))
+				continue
+			}
+			seen[key] = org.Name
+		}
+		if org.Parent != nil {
+			if *org.Parent == org.Name {
+				errs = append(errs, fmt.Sprintf("organization '%s': cannot be its own parent", org.Name))
+			} else if _, ok := names[*org.Parent]; !ok {
+				errs = append(errs, fmt.Sprintf("organization '%s': unknown parent '%s'", org.Name, *org.Parent))
+			}
+		}
+		if org.Start != "" && !validDate(org.Start) {
+			errs = append(errs, fmt.Sprintf("organization '%s': invalid date from '%s'", org.Name, org.Start))
+		}
+		if org.End != "" && !validDate(org.End) {
+			errs = append(errs, fmt.Sprintf("organization '%s': invalid date to '%s'", org.Name, org.End))
+		}
+		for _, domain := range org.Domains {
+			if domain == "" || strings.ContainsAny(domain, "!@ ") {
+				errs = append(errs, fmt.Sprintf("organization '%s': invalid domain '%s'", org.Name, domain))
+			}
+		}
+	}
+	for _, org := range d.Organizations {
+		seen := map[string]struct{}{}
+		for name := org.Name; name != ""; name = parents[name] {
+			if _, loop := seen[name]; loop {
+				errs = append(errs, fmt.Sprintf("organization '%s': parent cycle", org.Name))
+				break
+			}
+			seen[name] = struct{}{}
+		}
+	}
+	return
+}
+
+func (d *organizationsOutput) registry(present bool) *organizations {
+	o := &organizations{
+		present: present,
+		byName:  make(map[string]*organizationOutput),
+		aliases: make(map[string]string),
+		similar: make(map[string]string),
+	}
+	for _, org := range d.Organizations {
+		o.byName[org.Name] = org
+		o.names = append(o.names, org.Name)
+		o.aliases[strings.ToLower(org.Name)] = org.Name
+		for _, alias := range org.Aliases {
+			o.aliases[strings.ToLower(alias)] = org.Name
+		}
+	}
+	sort.Strings(o.names)
+	return o
+}
+
+func getOrganizations(ctx context.Context) (*organizations, bool) {
+	orgs, present, ok, err := readOrganizations(ctx)
+	if !ok || fatalOnError(ctx, err, false) {
+		return nil, false
+	}
+	errs := orgs.validate()
+	if len(errs) > 0 {
+		fatalf(ctx, false, "%s: %s", organizationsFile, strings.Join(errs, "\n"))
+		return nil, false
+	}
+	return orgs.registry(present), true
+}
+
+// canonical returns canonical organization name and true if name is already canonical,
+// returns canonical name and false for aliases, empty string and false for unknown organizations
+func (o *organizations) canonical(name string) (string, bool) {
+	if _, ok := o.byName[name]; ok {
+		return name, true
+	}
+	canon, ok := o.aliases[strings.ToLower(strings.TrimSpace(name))]
+	if ok {
+		return canon, false
+	}
+	return "", false
+}
+
+// suggest returns canonical organization name closest to a given unknown name
+func (o *organizations) suggest(name string) string {
+	sug, ok := o.similar[name]
+	if ok {
+		return sug
+	}
+	lName := strings.ToLower(name)
+	best := -1
+	for lAlias, canon := range o.aliases {
+		dist := levenshtein(lName, lAlias)
+		if best < 0 || dist < best || (dist == best && canon < sug) {
+			best = dist
+			sug = canon
+		}
+	}
+	o.similar[name] = sug
+	return sug
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func (o *organizations) checkName(name string) string {
+	canon, ok := o.canonical(name)
+	if ok {
+		return ""
+	}
+	if canon != "" {
+		return fmt.Sprintf("organization '%s' is an alias of '%s', use canonical name or run 'gitdm-sync fix-orgs'", name, canon)
+	}
+	sug := o.suggest(name)
+	if sug == "" {
+		return fmt.Sprintf("unknown organization '%s'", name)
+	}
+	return fmt.Sprintf("unknown organization '%s', did you mean '%s'?", name, sug)
+}
+
+// validateProfiles checks that all enrollments use canonical organization names and fit organization's active dates,
+// locs holds shard file location of each profile
+func (o *organizations) validateProfiles(profs []*allOutput, locs []profileLocation) (findings []*validationFinding) {
+	if !o.present {
+		return
+	}
+	for i, prof := range profs {
+		for _, rol := range prof.Enrollments {
+			msg := o.checkName(rol.Organization)
+			if msg != "" {
+				findings = append(findings, locs[i].finding(prof, msg))
+				continue
+			}
+			// enrollments are only checked against explicit active dates, existing data has enrollments with empty
+			// or reversed date ranges which would never fit
+			org := o.byName[rol.Organization]
+			if (org.Start != "" || org.End != "") && (rol.End <= org.start() || rol.Start >= org.end()) {
+				msg = fmt.Sprintf(
+					"enrollment %s - %s is outside of organization '%s' active dates %s - %s",
+					rol.Start, rol.End, org.Name, org.start(), org.end(),
+				)
+				findings = append(findings, locs[i].finding(prof, msg))
+			}
+		}
+	}
+	return
+}
+
+func (o *organizations) validateDomainRules(rules *domainRulesOutput) (findings []*validationFinding) {
+	if !o.present {
+		return
+	}
+	for _, rule := range rules.Rules {
+		msg := o.checkName(rule.Organization)
+		if msg != "" {
+			findings = append(findings, &validationFinding{File: domainsFile, Message: "domain '" + rule.Domain + "': " + msg})
+		}
+	}
+	return
+}
+
+// domainRules returns domain rules defined by organizations' domains
+func (o *organizations) domainRules() (rules []*domainRuleOutput) {
+	for _, name := range o.names {
+		org := o.byName[name]
+		for _, domain := range org.Domains {
+			rules = append(rules, &domainRuleOutput{Domain: domain, Organization: org.Name, Start: org.Start, End: org.End})
+		}
+	}
+	return
+}
+
+// fixOrgsCommand: gitdm-sync fix-orgs - rewrites organization aliases to canonical names in all profile files
+func fixOrgsCommand(ctx context.Context, args []string) bool {
+	orgs, ok := getOrganizations(ctx)
+	if !ok {
+		return false
+	}
+	if !orgs.present {
+		fatalf(ctx, false, "%s is required to fix organization names", organizationsFile)
+		return false
+	}
+	profs, ok := getProfilesFromYAMLs(ctx)
+	if !ok {
+		return false
+	}
+	fixed := 0
+	for _, prof := range profs {
+		for _, rol := range prof.Enrollments {
+			canon, ok := orgs.canonical(rol.Organization)
+			if ok || canon == "" {
+				continue
+			}
+			mPrintf(ctx, "'%s' -> '%s'\n", rol.Organization, canon)
+			rol.Organization = canon
+			fixed++
+		}
+	}
+	if fixed == 0 {
+		mPrintf(ctx, "no organization aliases found\n")
+		return true
+	}
+	removeCurrentYAMLs(ctx)
+	if !writeProfiles(ctx, profs) {
+		return false
+	}
+	mPrintf(ctx, "fixed %d enrollments\n", fixed)
+	return true
+}
+
+// initOrgsCommand: gitdm-sync init-orgs - creates organizations file from organizations used in profile files
+func initOrgsCommand(ctx context.Context, args []string) bool {
+	_, err := os.Stat(organizationsFile)
+	if err == nil {
+		fatalf(ctx, false, "%s already exists", organizationsFile)
+		return false
+	}
+	profs, ok := getProfilesFromYAMLs(ctx)
+	if !ok {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, prof := range profs {
+		for _, rol := range prof.Enrollments {
+			counts[rol.Organization]++
+		}
+	}
+	// names differing only by case are aliases of the most used one
+	variants := make(map[string][]string)
+	for name := range counts {
+		key := strings.ToLower(name)
+		variants[key] = append(variants[key], name)
+	}
+	var orgs organizationsOutput
+	for _, names := range variants {
+		sort.Slice(names, func(i, j int) bool {
+			if counts[names[i]] == counts[names[j]] {
+				return names[i] < names[j]
+			}
+			return counts[names[i]] > counts[names[j]]
+		})
+		orgs.Organizations = append(orgs.Organizations, &organizationOutput{Name: names[0], Aliases: names[1:]})
+	}
+	sort.Slice(orgs.Organizations, func(i, j int) bool {
+		return orgs.Organizations[i].Name < orgs.Organizations[j].Name
+	})
+	data, err := yaml.Marshal(&orgs)
+	if fatalOnError(ctx, err, false) {
+		return false
+	}
+	if fatalOnError(ctx, ioutil.WriteFile(organizationsFile, data, 0644), false) {
+		return false
+	}
+	mPrintf(ctx, "written %d organizations to %s\n", len(orgs.Organizations), organizationsFile)
+	return true
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOrganizationsValidateParents(t *testing.T) {
+	org := func(name, parent string) *organizationOutput {
+		o := &organizationOutput{Name: name}
+		if parent != "" {
+			o.Parent = &parent
+		}
+		return o
+	}
+	var cases = []struct {
+		name string
+		orgs []*organizationOutput
+		errs []string
+	}{
+		{
+			name: "tree",
+			orgs: []*organizationOutput{org("A", ""), org("B", "A"), org("C", "B")},
+		},
+		{
+			name: "self parent",
+			orgs: []*organizationOutput{org("A", "A")},
+			errs: []string{"organization 'A': cannot be its own parent"},
+		},
+		{
+			name: "unknown parent",
+			orgs: []*organizationOutput{org("A", "X")},
+			errs: []string{"organization 'A': unknown parent 'X'"},
+		},
+		{
+			name: "cycle",
+			orgs: []*organizationOutput{org("A", "C"), org("B", "A"), org("C", "B"), org("D", "A")},
+			errs: []string{
+				"organization 'A': parent cycle",
+				"organization 'B': parent cycle",
+				"organization 'C': parent cycle",
+				"organization 'D': parent cycle",
+			},
+		},
+	}
+	for _, c := range cases {
+		errs := (&organizationsOutput{Organizations: c.orgs}).validate()
+		if strings.Join(errs, "\n") != strings.Join(c.errs, "\n") {
+			t.Errorf("%s: got %q, want %q", c.name, errs, c.errs)
+		}
+	}
+}
+
+func TestOrganizationsValidateProfiles(t *testing.T) {
+	orgs := (&organizationsOutput{Organizations: []*organizationOutput{
+		{Name: "IBM", Aliases: []string{"IBM Corp"}},
+		{Name: "Acme", Start: "2010-01-01", End: "2015-01-01"},
+	}}).registry(true)
+	var cases = []struct {
+		name string
+		rol  *enrollmentShortOutput
+		msg  string
+	}{
+		{name: "canonical", rol: testEnrollment("IBM", "2012-01-01", "2100-01-01", nil)},
+		{name: "unknown", rol: testEnrollment("Initech", "2012-01-01", "2100-01-01", nil), msg: "unknown organization 'Initech'"},
+		{name: "alias", rol: testEnrollment("IBM Corp", "2012-01-01", "2100-01-01", nil), msg: "is an alias of 'IBM'"},
+		{name: "reversed dates without active dates", rol: testEnrollment("IBM", "2100-01-01", "2016-01-01", nil)},
+		{name: "within active dates", rol: testEnrollment("Acme", "2011-01-01", "2014-01-01", nil)},
+		{name: "outside active dates", rol: testEnrollment("Acme", "2016-01-01", "2100-01-01", nil), msg: "outside of organization 'Acme' active dates"},
+	}
+	for _, c := range cases {
+		findings := orgs.validateProfiles([]*allOutput{testProfile("Jo", "", "", c.rol)}, []profileLocation{{File: "profiles1.yaml", Line: 3}})
+		if c.msg == "" {
+			if len(findings) > 0 {
+				t.Errorf("%s: got findings %v", c.name, findings)
+			}
+			continue
+		}
+		if len(findings) != 1 || !strings.Contains(findings[0].Message, c.msg) || findings[0].Line != 3 {
+			t.Errorf("%s: got findings %v, want one containing %q", c.name, findings, c.msg)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "sync"
+
+// runParallel calls fn for 0..n-1 using at most workers goroutines, the error of the lowest index is returned,
+// so the result doesn't depend on scheduling
+func runParallel(n, workers int, fn func(int) error) error {
+	errs := make([]error, n)
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,9 +4,19 @@ then
   echo "$0: please provide PR number via PR=..."
   exit 1
 fi
-GITHUB_REF="refs/pull/${PR}/merge"
 if [ -z "${SYNC_URL}" ]
 then
   SYNC_URL='localhost:7070'
 fi
-(curl -s "${SYNC_URL}/pr/${GITHUB_REF}" |& tee output.txt | grep 'CHECK_OK') || ( cat output.txt; exit 1)
+if [ -z "${SYNC_TOKEN}" ]
+then
+  SYNC_TOKEN=`cat secrets/GITDM_API_TOKEN.secret`
+fi
+if [ -z "${GITHUB_REPO}" ]
+then
+  GITHUB_REPO=`cat secrets/GITDM_GITHUB_REPO.secret`
+fi
+# pull_request event with PR's current head and base SHAs, so the check is pinned to them
+curl -s -f "https://api.github.com/repos/${GITHUB_REPO}/pulls/${PR}" > pr.json || { echo "$0: cannot get PR ${PR} of ${GITHUB_REPO}"; exit 1; }
+jq '{action: "synchronize", number: .number, pull_request: .}' pr.json > event.json || exit 1
+(curl -s -X POST -H "Authorization: Bearer ${SYNC_TOKEN}" -H "X-GitHub-Event: pull_request" -H "Content-Type: application/json" --data-binary @event.json "${SYNC_URL}/webhook" |& tee output.txt | grep 'CHECK_OK') || ( cat output.txt; exit 1)